@@ -1,16 +1,40 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/ForAllSecure/rootfs_builder/log"
 	"github.com/ForAllSecure/rootfs_builder/rootfs"
 )
 
+const usage = "Usage: rootfs_builder <config.json>\n" +
+	"\t\t\t\t\t--digest-only: only print the digest\n" +
+	"\t\t\t\t\t--dry-run: only list the files, without extracting\n" +
+	"       rootfs_builder ls <config.json>\n" +
+	"       rootfs_builder verify <manifest> <rootfs>\n" +
+	"       rootfs_builder push <push.json>\n" +
+	"       rootfs_builder commit <config.json>"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verify()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "push" {
+		push()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "commit" {
+		commit()
+		return
+	}
+	// ls is an alias of --dry-run
+	if len(os.Args) == 3 && os.Args[1] == "ls" {
+		os.Args = []string{os.Args[0], os.Args[2], "--dry-run"}
+	}
 	if len(os.Args) > 3 || len(os.Args) < 2 {
-		log.Fatal("Usage: rootfs_builder <config.json>\n" +
-			"\t\t\t\t\t--digest-only: only print the digest")
+		log.Fatal(usage)
 	}
 	// Initialize pullable image from config
 	pullableImage, err := rootfs.NewPullableImage(os.Args[1])
@@ -31,6 +55,12 @@ func main() {
 			log.Errorf("Failed to extract rootfs: %+v", err)
 			os.Exit(1)
 		}
+	} else if os.Args[2] == "--dry-run" {
+		err = pulledManifest.List(os.Stdout)
+		if err != nil {
+			log.Errorf("Failed to list rootfs: %+v", err)
+			os.Exit(1)
+		}
 	} else {
 		// Digest only
 		digest, err := pulledManifest.Digest()
@@ -41,3 +71,60 @@ func main() {
 		log.Info(digest)
 	}
 }
+
+// verify checks a rootfs against its manifest, and exits with 1 if it drifted
+func verify() {
+	if len(os.Args) != 4 {
+		log.Fatal(usage)
+	}
+	drifts, err := rootfs.VerifyManifest(os.Args[2], os.Args[3])
+	if err != nil {
+		log.Errorf("Failed to verify rootfs: %+v", err)
+		os.Exit(1)
+	}
+	for _, drift := range drifts {
+		fmt.Println(drift)
+	}
+	if len(drifts) > 0 {
+		log.Errorf("%s doesn't match %s: %d differences", os.Args[3], os.Args[2], len(drifts))
+		os.Exit(1)
+	}
+}
+
+// push uploads a local image to a registry
+func push() {
+	if len(os.Args) != 3 {
+		log.Fatal(usage)
+	}
+	pushableImage, err := rootfs.NewPushableImage(os.Args[2])
+	if err != nil {
+		log.Errorf("Failed to initialize image from config: %+v", err)
+		os.Exit(1)
+	}
+	if err := pushableImage.Push(); err != nil {
+		log.Errorf("Failed to push image: %+v", err)
+		os.Exit(1)
+	}
+}
+
+// commit writes the image of the extracted rootfs with its changes as a new
+// layer
+func commit() {
+	if len(os.Args) != 3 {
+		log.Fatal(usage)
+	}
+	pullableImage, err := rootfs.NewPullableImage(os.Args[2])
+	if err != nil {
+		log.Errorf("Failed to initialize image from config: %+v", err)
+		os.Exit(1)
+	}
+	pulledManifest, err := pullableImage.Pull()
+	if err != nil {
+		log.Errorf("Failed to pull image manifest: %+v", err)
+		os.Exit(1)
+	}
+	if err := pulledManifest.Commit(); err != nil {
+		log.Errorf("Failed to commit rootfs: %+v", err)
+		os.Exit(1)
+	}
+}
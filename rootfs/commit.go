@@ -0,0 +1,246 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// Commit captures the changes made to Dest/rootfs since it was extracted,
+// according to its manifest, as a new layer, and writes the image stacking
+// it on the extracted layers and injections to Export.Path. Everything is
+// taken from the rootfs, including the injected files. The rootfs must have
+// been extracted from this image with the same settings, and with Manifest
+// set.
+func (pulledImg *PulledImage) Commit() error {
+	dest := pulledImg.spec.Dest
+	if err := pulledImg.validateImageExport(); err != nil {
+		return err
+	}
+	lock, err := lockDest(dest)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := pulledImg.validateUser(); err != nil {
+		return err
+	}
+
+	layers, err := pulledImg.layers()
+	if err != nil {
+		return err
+	}
+	rootfsPath := filepath.Join(dest, "rootfs")
+	record, err := pulledImg.newProvenance(layers)
+	if err != nil {
+		return err
+	}
+	previous, err := readProvenance(dest)
+	if err != nil {
+		return err
+	}
+	if previous == nil || len(previous.Layers) != len(record.Layers) || commonLayers(previous, record) != len(record.Layers) {
+		return errors.Errorf("%s wasn't extracted from %s with these settings", rootfsPath, pulledImg.name)
+	}
+	manifestPath := filepath.Join(dest, ManifestFile)
+	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+		return errors.Errorf("%s has no manifest to compare it with, extract it with Manifest set", rootfsPath)
+	}
+	drifts, err := VerifyManifest(manifestPath, rootfsPath)
+	if err != nil {
+		return err
+	}
+
+	// Files hard linked by the store would be committed as hard links
+	keepLinks := !pulledImg.spec.StoreHardlinks
+	o := pulledImg.owner()
+	layerPath, err := writeLayerFile(dest, func(w io.Writer) error {
+		return writeDiff(w, rootfsPath, drifts, o, keepLinks)
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layerPath)
+	layer, err := tarball.LayerFromFile(layerPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	digest, err := layer.Digest()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Infof("Committed %d changes to %s as layer %s", len(drifts), rootfsPath, digest)
+
+	// The history of the new layers has the image's creation time, so the
+	// same rootfs always gives the same image
+	configFile, err := pulledImg.img.ConfigFile()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	created := configFile.Created
+
+	// The extra layers are part of what was extracted
+	img, err := mutate.AppendLayers(pulledImg.img, layers[len(layers)-len(pulledImg.spec.ExtraLayers):]...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// So are the injections, which the manifest already has
+	if len(previous.Injected) > 0 {
+		injectedPath, err := writeLayerFile(dest, func(w io.Writer) error {
+			return writeInjected(w, rootfsPath, previous.Injected, o, keepLinks)
+		})
+		if err != nil {
+			return err
+		}
+		defer os.Remove(injectedPath)
+		injected, err := tarball.LayerFromFile(injectedPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var sources []string
+		for _, inj := range pulledImg.spec.Inject {
+			sources = append(sources, inj.Source)
+		}
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer: injected,
+			History: v1.History{
+				Created:   created,
+				CreatedBy: "rootfs_builder inject",
+				Comment:   strings.Join(sources, ", "),
+			},
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	img, err = mutate.Append(img, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			Created:   created,
+			CreatedBy: "rootfs_builder commit",
+			Comment:   fmt.Sprintf("%d changes to %s", len(drifts), pulledImg.name),
+		},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return pulledImg.writeImage(img)
+}
+
+// writeLayerFile writes a layer with write to a temporary file in dir, and
+// returns its path
+func writeLayerFile(dir string, write func(io.Writer) error) (string, error) {
+	f, err := ioutil.TempFile(dir, ".rootfs-commit-*.tar")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = errors.WithStack(closeErr)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeInjected writes the injected paths of the tree at rootfs to w as a
+// layer, as writeDiff does. Whiteouts are written as they were injected, and
+// paths which were removed since are left to the diff.
+func writeInjected(w io.Writer, rootfs string, injected []string, o owner, keepLinks bool) error {
+	tw := tar.NewWriter(w)
+	var links map[inode]string
+	if keepLinks {
+		links = make(map[inode]string)
+	}
+	for _, name := range injected {
+		if isWhiteout(path.Base(name)) {
+			hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrapf(err, "writing whiteout %s", name)
+			}
+			continue
+		}
+		filePath := filepath.Join(rootfs, filepath.FromSlash(name))
+		fi, err := os.Lstat(filePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := writeTarEntry(tw, filePath, name, fi, o, links); err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(tw.Close())
+}
+
+// writeDiff writes the drifted paths of the tree at rootfs to w as a layer.
+// Added and modified paths are written as writeTar does, and missing paths
+// become whiteouts. Hard linked files are written as copies unless
+// keepLinks is set.
+func writeDiff(w io.Writer, rootfs string, drifts []Drift, o owner, keepLinks bool) error {
+	tw := tar.NewWriter(w)
+	var links map[inode]string
+	if keepLinks {
+		links = make(map[inode]string)
+	}
+	removed := make(map[string]bool)
+	written := make(map[string]bool)
+	for _, drift := range drifts {
+		// The root of a layer isn't extracted
+		if drift.Path == "." {
+			continue
+		}
+		name := strings.TrimPrefix(drift.Path, "./")
+		parent := path.Dir(name)
+		if drift.Kind == DriftMissing {
+			removed[name] = true
+			// Removed along with its parent
+			if removed[parent] {
+				continue
+			}
+			// Replaced along with its parent, which is no longer a
+			// directory
+			if fi, err := os.Lstat(filepath.Join(rootfs, parent)); err != nil || !fi.IsDir() {
+				continue
+			}
+			hdr := &tar.Header{
+				Name:     path.Join(parent, whiteoutPrefix+path.Base(name)),
+				Typeflag: tar.TypeReg,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrapf(err, "writing whiteout for %s", name)
+			}
+			continue
+		}
+
+		// A path may be both modified and owned by someone else
+		if written[name] {
+			continue
+		}
+		written[name] = true
+		filePath := filepath.Join(rootfs, filepath.FromSlash(name))
+		fi, err := os.Lstat(filePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := writeTarEntry(tw, filePath, name, fi, o, links); err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(tw.Close())
+}
@@ -0,0 +1,150 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommit(t *testing.T) {
+	t.Run("unmapped", func(t *testing.T) {
+		testCommit(t, false)
+	})
+	t.Run("mapped", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("mapping ownership to subuids needs root")
+		}
+		testCommit(t, true)
+	})
+}
+
+// testCommit commits changes to a rootfs extracted with the ownership mapped
+// to subuids, or to the current user
+func testCommit(t *testing.T, mapped bool) {
+	dir, err := ioutil.TempDir("", "commit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "dest")
+	require.NoError(t, os.Mkdir(dest, 0755))
+
+	layer := testLayer(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/issue", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "var/cache/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "var/cache/old", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/motd": "hello", "etc/issue": "issue", "var/cache/old": "old"})
+	motd := filepath.Join(dir, "motd")
+	require.NoError(t, ioutil.WriteFile(motd, []byte("injected"), 0644))
+	pulledImg := &PulledImage{
+		img:  testImage(t, layer),
+		name: "example.com/test:latest",
+		spec: Spec{
+			Dest:     dest,
+			Manifest: true,
+			Inject:   []Inject{{Source: motd, Dest: "/etc/motd.d/injected", Uid: 1000, Gid: 1000}},
+			Export:   Export{Path: filepath.Join(dir, "image"), Format: FormatOCI},
+		},
+	}
+	if mapped {
+		mapping := []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+		pulledImg.spec.UIDMappings, pulledImg.spec.GIDMappings = mapping, mapping
+	}
+	require.NoError(t, pulledImg.validateUser())
+	require.NoError(t, pulledImg.extractRootfs([]v1.Layer{layer}))
+
+	// What a provisioning script would do
+	rootfs := filepath.Join(dest, "rootfs")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "etc", "motd"), []byte("changed"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(rootfs, "etc", "issue")))
+	require.NoError(t, os.RemoveAll(filepath.Join(rootfs, "var", "cache")))
+	app := filepath.Join(rootfs, "etc", "app")
+	require.NoError(t, ioutil.WriteFile(app, []byte("app"), 0600))
+	appUid := 0
+	if mapped {
+		require.NoError(t, os.Lchown(app, 101000, 101000))
+		appUid = 1000
+	}
+	// Injected files are taken from the rootfs, not from the host
+	require.NoError(t, ioutil.WriteFile(motd, []byte("changed on the host"), 0644))
+
+	require.NoError(t, pulledImg.Commit())
+	img, err := LoadImage(pulledImg.spec.Export.Path, "")
+	require.NoError(t, err)
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	require.Len(t, cfg.RootFS.DiffIDs, 3)
+	require.Len(t, cfg.History, 3)
+
+	// The injection is a layer of its own, as the rootfs has it
+	require.Equal(t, map[string]int{"etc/": 0, "etc/motd.d/": 0, "etc/motd.d/injected": 1000}, layerOwners(t, layers[1]))
+	rc, err := layers[1].Uncompressed()
+	require.NoError(t, err)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Name == "etc/motd.d/injected" {
+			data, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			require.Equal(t, "injected", string(data))
+		}
+	}
+	rc.Close()
+	// The directories changed along with their entries, and the removed
+	// directory is a single whiteout
+	require.Equal(t, map[string]int{
+		"etc/":          0,
+		"etc/.wh.issue": 0,
+		"etc/app":       appUid,
+		"etc/motd":      0,
+		"var/":          0,
+		"var/.wh.cache": 0,
+	}, layerOwners(t, layers[2]))
+
+	// The same rootfs always gives the same image
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	pulledImg.spec.Export.Path = filepath.Join(dir, "image2")
+	require.NoError(t, pulledImg.Commit())
+	img, err = LoadImage(pulledImg.spec.Export.Path, "")
+	require.NoError(t, err)
+	again, err := img.Digest()
+	require.NoError(t, err)
+	require.Equal(t, digest, again)
+
+	// A rootfs from another image can't be committed on this one
+	pulledImg.img = testImage(t, layer, layer)
+	require.Error(t, pulledImg.Commit())
+}
+
+// layerOwners maps the names of the entries of layer to their owner
+func layerOwners(t *testing.T, layer v1.Layer) map[string]int {
+	rc, err := layer.Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	owners := make(map[string]int)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		owners[hdr.Name] = hdr.Uid
+	}
+	return owners
+}
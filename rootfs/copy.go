@@ -0,0 +1,176 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/pkg/errors"
+)
+
+// copyTree copies the tree at src to dst, preserving ownership, modes,
+// timestamps and hard links. Directories of dst are left writable and their
+// metadata is recorded in dirs, to be applied by setDirMetadata. The metadata
+// in pending overrides that of the matching src directories, whose mode on
+// disk may not be final yet.
+func copyTree(src string, dst string, pending map[string]dirMeta, dirs map[string]dirMeta) error {
+	links := make(map[inode]string)
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("unsupported file info for %s", path)
+		}
+		uid, gid := int(st.Uid), int(st.Gid)
+		atime := timespecTime(st.Atim)
+		mtime := fi.ModTime()
+
+		if fi.IsDir() {
+			meta, ok := pending[path]
+			if !ok {
+				meta = dirMeta{mode: fi.Mode(), uid: uid, gid: gid, atime: atime, mtime: mtime}
+			}
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, meta.mode.Perm()|0700); err != nil {
+				return err
+			}
+			if err := copyRootlessOwner(path, target); err != nil {
+				return err
+			}
+			if err := copyLabel(path, target); err != nil {
+				return err
+			}
+			dirs[target] = meta
+			return nil
+		}
+
+		// Keep hard links linked
+		if st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := links[key]; ok {
+				return os.Link(first, target)
+			}
+			links[key] = target
+		}
+
+		switch {
+		case fi.Mode().IsRegular():
+			if err := copyFile(path, target, fi.Mode()); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		default:
+			// Devices, fifos and sockets
+			if err := syscall.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				log.Warnf("Failed to copy special file %s: %s", rel, err)
+				return nil
+			}
+		}
+
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if err := copyRootlessOwner(path, target); err != nil {
+				return err
+			}
+		}
+		if err := copyLabel(path, target); err != nil {
+			return err
+		}
+		// chown clears setuid and setgid
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if err := os.Chmod(target, fi.Mode()); err != nil {
+				return err
+			}
+		}
+		return lchtimes(target, atime, mtime)
+	})
+}
+
+// copyRootlessOwner copies the rootlesscontainers xattr of src, if any
+func copyRootlessOwner(src string, dst string) error {
+	uid, gid, err := rootlessOwner(src)
+	if err != nil || (uid == 0 && gid == 0) {
+		return err
+	}
+	return setRootlessOwner(dst, uid, gid)
+}
+
+// copyFile copies the content of a regular file, sharing its blocks if
+// possible
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if reflink(out, in) == 0 {
+		return out.Close()
+	}
+	if _, err := writeSparse(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "copying %s", src)
+	}
+	return out.Close()
+}
+
+// loadDirMetadata records the metadata of the directories of an existing
+// tree in dirs, and makes them writable so that more layers can be extracted
+// on top
+func loadDirMetadata(root string, dirs map[string]dirMeta) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("unsupported file info for %s", path)
+		}
+		dirs[path] = dirMeta{
+			mode:  fi.Mode(),
+			uid:   int(st.Uid),
+			gid:   int(st.Gid),
+			atime: timespecTime(st.Atim),
+			mtime: fi.ModTime(),
+		}
+		return os.Chmod(path, fi.Mode().Perm()|0700)
+	})
+}
+
+// removeAll is os.RemoveAll, but also removes trees with read-only
+// directories when not running as root
+func removeAll(path string) error {
+	err := os.RemoveAll(path)
+	if err == nil || !os.IsPermission(err) {
+		return err
+	}
+	_ = filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			_ = os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,111 @@
+package rootfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/pkg/errors"
+)
+
+// LockFile is the name of the file, in Dest, locked for the whole extraction
+// so that concurrent runs don't extract into the same Dest
+const LockFile = ".lock"
+
+// Policies for Spec.Conflict, what to do when Dest isn't empty
+const (
+	// ConflictFail refuses to extract into a Dest which isn't empty
+	ConflictFail = "fail"
+	// ConflictReplace removes what Dest holds and extracts from scratch
+	ConflictReplace = "replace"
+	// ConflictMerge extracts on top of what Dest holds, reusing the layers
+	// of a previous run. This is the default.
+	ConflictMerge = "merge"
+)
+
+// lockDest takes the lock on dest, failing if another run holds it. The lock
+// is held until the returned file is closed.
+func lockDest(dest string) (*os.File, error) {
+	path := filepath.Join(dest, LockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("%s is locked by another extraction%s", dest, lockHolder(path))
+		}
+		return nil, errors.Wrapf(err, "locking %s", path)
+	}
+	// For the error of the runs which find it locked
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	log.Debugf("Locked %s", path)
+	return f, nil
+}
+
+// lockHolder describes the process holding the lock at path, if known
+func lockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	pid := strings.TrimSpace(string(data))
+	if err != nil || pid == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (pid %s)", pid)
+}
+
+// resolveConflict applies the Conflict policy to what Dest already holds.
+// The rootfs itself is left to extractRootfs when replacing it, so that it
+// stays in place until the new one is complete, and the Snapshots and Store
+// directories are kept.
+func (pulledImg *PulledImage) resolveConflict() error {
+	dest := pulledImg.spec.Dest
+	entries, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != LockFile {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	switch pulledImg.spec.Conflict {
+	case ConflictFail:
+		return errors.Errorf("%s isn't empty, it holds %s; set Conflict to %q or %q to extract anyway",
+			dest, strings.Join(names, ", "), ConflictReplace, ConflictMerge)
+	case ConflictReplace:
+		log.Infof("Replacing the contents of %s", dest)
+		// Snapshots and the content store are shared between images
+		shared := make(map[string]bool)
+		for _, dir := range []string{pulledImg.spec.Snapshots, pulledImg.spec.Store} {
+			if abs, err := filepath.Abs(dir); dir != "" && err == nil {
+				shared[abs] = true
+			}
+		}
+		for _, name := range names {
+			path := filepath.Join(dest, name)
+			if name == "rootfs" {
+				continue
+			}
+			if abs, _ := filepath.Abs(path); shared[abs] {
+				continue
+			}
+			if err := removeAll(path); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
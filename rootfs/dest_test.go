@@ -0,0 +1,80 @@
+package rootfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockDest(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	lock, err := lockDest(dest)
+	require.NoError(t, err)
+	_, err = lockDest(dest)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "locked by another extraction")
+
+	require.NoError(t, lock.Close())
+	lock, err = lockDest(dest)
+	require.NoError(t, err)
+	require.NoError(t, lock.Close())
+}
+
+func TestConflict(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	a, b := fileLayer(t, "a"), fileLayer(t, "b")
+	extractSpec := func(spec Spec) error {
+		spec.Dest = dest
+		pulledImg := &PulledImage{img: testImage(t, a, b), name: "test", spec: spec}
+		return pulledImg.Extract()
+	}
+	extract := func(conflict string) error {
+		return extractSpec(Spec{Conflict: conflict})
+	}
+	exists := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(dest, name))
+		return err == nil
+	}
+
+	// An empty Dest is fine whatever the policy
+	require.NoError(t, extract(ConflictFail))
+	require.True(t, exists("rootfs/a") && exists("rootfs/b"))
+
+	err = extract(ConflictFail)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "isn't empty")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "rootfs", "marker"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "stray"), nil, 0644))
+	require.NoError(t, extract(ConflictMerge))
+	require.True(t, exists("rootfs/marker") && exists("stray"))
+
+	require.NoError(t, extract(ConflictReplace))
+	require.True(t, exists("rootfs/a") && exists("rootfs/b") && exists(ProvenanceFile))
+	require.False(t, exists("rootfs/marker") || exists("stray"))
+
+	require.Error(t, extract("overwrite"))
+
+	// An invalid spec fails before anything is removed
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "stray"), nil, 0644))
+	err = extractSpec(Spec{Conflict: ConflictReplace, Output: OutputOverlay, Include: []string{"/etc"}})
+	require.Error(t, err)
+	require.True(t, exists("stray") && exists("rootfs/a"))
+
+	// The content store is shared, like snapshots
+	store := filepath.Join(dest, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(store, "marker"), nil, 0644))
+	require.NoError(t, extractSpec(Spec{Conflict: ConflictReplace, Store: store}))
+	require.True(t, exists("store/marker"))
+	require.False(t, exists("stray"))
+}
@@ -0,0 +1,273 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// Compression formats for Export.Compression
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	// zstd compression uses the zstd command, which must be in PATH
+	CompressionZstd = "zstd"
+)
+
+// Export writes the flattened rootfs as a tar, for OutputTar, or as an
+// image, for OutputImage
+type Export struct {
+	// File to write the tar to, or - for stdout. Where to write the image
+	// to, a directory for FormatOCI.
+	Path string
+	// Compression of the tar, none by default
+	Compression string
+	// Format of the image, FormatOCI by default
+	Format string
+	// Tag of the image, the pulled image's name by default for
+	// FormatDockerArchive, and none for FormatOCI
+	Tag string
+	// Write the host IDs the extracted files are owned by, i.e. shifted to
+	// User or its subuids, rather than the image's own
+	KeepHostIDs bool
+}
+
+// exportTar flattens the layers into a temporary directory under Dest and
+// writes it out as a tar
+func (pulledImg *PulledImage) exportTar(layers []v1.Layer) error {
+	export := pulledImg.spec.Export
+	rootfsPath, err := ioutil.TempDir(pulledImg.spec.Dest, ".rootfs-export-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(rootfsPath)
+	if err := pulledImg.flatten(layers, rootfsPath); err != nil {
+		return err
+	}
+
+	o := pulledImg.owner()
+	if export.KeepHostIDs {
+		o = owner{}
+	}
+	w, err := createExport(export)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Exporting rootfs to %s", export.Path)
+	if err := writeTar(w, rootfsPath, o); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// validateTarExport checks Export before the rootfs is flattened for it, so
+// that a missing zstd command doesn't fail the export halfway
+func (pulledImg *PulledImage) validateTarExport() error {
+	export := pulledImg.spec.Export
+	if export.Path == "" {
+		return errors.New("Specify a path to export the rootfs tar to")
+	}
+	switch export.Compression {
+	case CompressionNone, CompressionGzip:
+	case CompressionZstd:
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return errors.Wrap(err, "zstd compression needs the zstd command")
+		}
+	default:
+		return errors.Errorf("unknown compression %q", export.Compression)
+	}
+	return nil
+}
+
+// exportWriter writes an export, closing every stage of the pipeline in order
+type exportWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (w *exportWriter) Close() error {
+	var err error
+	for _, closer := range w.closers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// cmdCloser closes the input of a command and waits for it to exit
+type cmdCloser struct {
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+func (c *cmdCloser) Close() error {
+	if err := c.stdin.Close(); err != nil {
+		return err
+	}
+	return errors.Wrapf(c.cmd.Wait(), "running %s", c.cmd.Path)
+}
+
+// nopCloser keeps stdout open
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// createExport opens the export file and sets up its compression
+func createExport(export Export) (io.WriteCloser, error) {
+	var file io.WriteCloser = os.Stdout
+	var fileCloser io.Closer = nopCloser{}
+	if export.Path != "-" {
+		f, err := os.Create(export.Path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		file, fileCloser = f, f
+	}
+
+	switch export.Compression {
+	case CompressionNone:
+		return &exportWriter{Writer: file, closers: []io.Closer{fileCloser}}, nil
+	case CompressionGzip:
+		gw := gzip.NewWriter(file)
+		return &exportWriter{Writer: gw, closers: []io.Closer{gw, fileCloser}}, nil
+	case CompressionZstd:
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = file
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			fileCloser.Close()
+			return nil, errors.Wrap(err, "starting zstd")
+		}
+		zw := &cmdCloser{cmd: cmd, stdin: stdin}
+		return &exportWriter{Writer: stdin, closers: []io.Closer{zw, fileCloser}}, nil
+	default:
+		fileCloser.Close()
+		return nil, errors.Errorf("unknown compression %q", export.Compression)
+	}
+}
+
+// inode identifies a file, to find hard links
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// writeTar writes the tree at rootfs to w. Entries are written in lexical
+// order and only carry what comes from the image, so the same tree always
+// produces the same tar. Ownership is mapped back through the mappings of
+// o, or read from the rootlesscontainers xattrs when o is rootless.
+func writeTar(w io.Writer, rootfs string, o owner) error {
+	tw := tar.NewWriter(w)
+	links := make(map[inode]string)
+	err := filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == rootfs {
+			return nil
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		return writeTarEntry(tw, path, filepath.ToSlash(rel), fi, o, links)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeTarEntry writes the file at path to tw as name, see writeTar
+func writeTarEntry(tw *tar.Writer, path string, name string, fi os.FileInfo, o owner, links map[inode]string) error {
+	hdr, err := tarHeader(path, name, fi, links)
+	if err != nil {
+		return err
+	}
+	if o.rootless {
+		// Symlinks can't have the xattr, so belong to root
+		hdr.Uid, hdr.Gid = 0, 0
+		if hdr.Typeflag != tar.TypeSymlink {
+			if hdr.Uid, hdr.Gid, err = rootlessOwner(path); err != nil {
+				return err
+			}
+		}
+	}
+	// IDs which aren't mapped, such as the overflow ID, are kept
+	if uid, ok := o.uids.toContainer(hdr.Uid); ok {
+		hdr.Uid = uid
+	}
+	if gid, ok := o.gids.toContainer(hdr.Gid); ok {
+		hdr.Gid = gid
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "writing header for %s", name)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return errors.Wrapf(err, "writing %s", name)
+}
+
+// tarHeader builds the header for the file at path. Regular files which
+// were already written under another name become hard links, unless links
+// is nil.
+func tarHeader(path string, name string, fi os.FileInfo, links map[inode]string) (*tar.Header, error) {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// Drop what depends on the host or on when the rootfs was extracted
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && links != nil && fi.Mode().IsRegular() && st.Nlink > 1 {
+		key := inode{dev: uint64(st.Dev), ino: st.Ino}
+		if first, ok := links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			links[key] = hdr.Name
+		}
+	}
+	return hdr, nil
+}
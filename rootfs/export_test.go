@@ -0,0 +1,116 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTar(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	mtime := time.Unix(1500000000, 0)
+	tr := buildTar(t, []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "usr/bin/b", Typeflag: tar.TypeReg, Mode: 0755, ModTime: mtime},
+		{Name: "usr/bin/a", Typeflag: tar.TypeLink, Linkname: "usr/bin/b", ModTime: mtime},
+		{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin", ModTime: mtime},
+	}, map[string]string{"usr/bin/b": "binary"})
+	dirs := make(map[string]dirMeta)
+	require.NoError(t, handleFiles(tr, rootfs, testOwner(), dirs, nil, nil, nil))
+	require.NoError(t, setDirMetadata(dirs))
+
+	// The same tree always gives the same tar
+	var first, second bytes.Buffer
+	require.NoError(t, writeTar(&first, rootfs, testOwner()))
+	require.NoError(t, writeTar(&second, rootfs, testOwner()))
+	require.Equal(t, first.Bytes(), second.Bytes())
+
+	var names []string
+	reader := tar.NewReader(&first)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		require.Equal(t, 0, hdr.Uid)
+		require.Equal(t, 0, hdr.Gid)
+		require.True(t, mtime.Equal(hdr.ModTime), hdr.Name)
+		switch hdr.Name {
+		case "bin":
+			require.Equal(t, byte(tar.TypeSymlink), hdr.Typeflag)
+			require.Equal(t, "usr/bin", hdr.Linkname)
+		case "usr/bin/a":
+			require.Equal(t, byte(tar.TypeReg), hdr.Typeflag)
+		case "usr/bin/b":
+			require.Equal(t, byte(tar.TypeLink), hdr.Typeflag)
+			require.Equal(t, "usr/bin/a", hdr.Linkname)
+		}
+	}
+	require.Equal(t, []string{"bin", "usr/", "usr/bin/", "usr/bin/a", "usr/bin/b"}, names)
+}
+
+// Test that a tar export which can't be written fails before extracting
+func TestValidateTarExport(t *testing.T) {
+	pulledImg := &PulledImage{spec: Spec{Output: OutputTar}}
+	require.Error(t, pulledImg.validateTarExport())
+	pulledImg.spec.Export = Export{Path: "rootfs.tar", Compression: "lz4"}
+	require.Error(t, pulledImg.validateTarExport())
+	pulledImg.spec.Export.Compression = CompressionGzip
+	require.NoError(t, pulledImg.validateTarExport())
+
+	// Without the zstd command in PATH
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	require.NoError(t, os.Setenv("PATH", ""))
+	pulledImg.spec.Export.Compression = CompressionZstd
+	err := pulledImg.validateTarExport()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "zstd")
+}
+
+// Test that files the store links together aren't exported as hard links
+func TestExportStoreHardlinks(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	layer := testLayer(t, []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "b", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"a": "same", "b": "same"})
+	tarPath := filepath.Join(dest, "rootfs.tar")
+	pulledImg := testPulledImage(t, testImage(t, layer), Spec{
+		Dest:           dest,
+		Output:         OutputTar,
+		Export:         Export{Path: tarPath},
+		Store:          filepath.Join(dest, "store"),
+		StoreHardlinks: true,
+	})
+	require.NoError(t, pulledImg.Extract())
+
+	f, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer f.Close()
+	reader := tar.NewReader(f)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, byte(tar.TypeReg), hdr.Typeflag, hdr.Name)
+	}
+}
@@ -10,12 +10,13 @@ package rootfs
 
 import (
 	"archive/tar"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/ForAllSecure/rootfs_builder/log"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -23,19 +24,58 @@ import (
 	"github.com/pkg/errors"
 )
 
-// extract a single file
-func extractFile(dest string, hdr *tar.Header, tr io.Reader, subuid int, subgid int) error {
-	// Construct filepath from tar header
-	path := filepath.Join(dest, filepath.Clean(hdr.Name))
+// dirMeta is the metadata of an extracted directory. It is applied after all
+// layers are extracted, so that restrictive modes (e.g. 0555) don't prevent
+// the directory's children from being created.
+type dirMeta struct {
+	mode  os.FileMode
+	uid   int
+	gid   int
+	atime time.Time
+	mtime time.Time
+	// uid and gid are recorded in an xattr rather than applied, see owner
+	rootless bool
+	// SELinux context, empty to leave the file's alone
+	label string
+}
+
+// owner is who the extracted files belong to
+type owner struct {
+	// Map the image's uids and gids to the host's
+	uids idMap
+	gids idMap
+	// What to do with IDs outside of the mappings, see Spec.IDOverflow
+	overflow string
+	// The kernel's overflow uid and gid, read once for IDOverflowHost
+	overflowUID, overflowGID int
+	// Resolves the image's user and group names, nil to use its IDs
+	names *nameResolver
+	// Keep the files owned by the invoking user, and record the image's
+	// ownership in the user.rootlesscontainers xattr instead
+	rootless bool
+	// How the files are labeled
+	selinux SELinux
+}
+
+// extract a single file, storing regular files' content in s if set
+func extractFile(dest string, hdr *tar.Header, tr io.Reader, o owner, dirs map[string]dirMeta, s *contentStore) error {
+	// Construct filepath from tar header, without going out of dest
+	path, err := securePath(dest, hdr.Name)
+	if err != nil {
+		return err
+	}
 	dir := filepath.Dir(path)
 
 	// Get metadata from tar header
-	mode := hdr.FileInfo().Mode()
-	uid := hdr.Uid + subuid
-	gid := hdr.Gid + subgid
+	meta, err := headerMeta(hdr, o)
+	if err != nil {
+		return err
+	}
+	mode, atime := meta.mode, meta.atime
 
 	switch hdr.Typeflag {
-	case tar.TypeReg:
+	// Holes of GNU sparse entries read as zeros, which writeSparse skips
+	case tar.TypeReg, tar.TypeGNUSparse:
 		// It's possible a file is in the tar before it's directory.
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
 			if err := os.MkdirAll(dir, 0755); err != nil {
@@ -44,37 +84,45 @@ func extractFile(dest string, hdr *tar.Header, tr io.Reader, subuid int, subgid
 		}
 		// Check if something already exists at path (symlinks etc.)
 		// If so, delete it
-		if _, err := os.Lstat(path); !os.IsNotExist(err) {
-			if err := os.RemoveAll(path); err != nil {
-				return errors.Wrapf(err, "error removing %s to make way for new file.", path)
-			}
+		if err := replacePath(path, dirs); err != nil {
+			return errors.Wrapf(err, "error removing %s to make way for new file.", path)
 		}
-		currFile, err := os.Create(path)
-		if err != nil {
+		linkPath, linked, err := s.extract(tr, path, meta)
+		if err != nil || linked {
 			return err
 		}
-		// manually set permissions on file, since the default umask (022) will interfere
-		if err = os.Chmod(path, mode); err != nil {
+		if err := meta.chown(path); err != nil {
 			return err
 		}
-		if _, err = io.Copy(currFile, tr); err != nil {
+		// manually set permissions on file, since the default umask (022)
+		// will interfere, and after chown, which clears setuid and setgid
+		if err := meta.chmod(path); err != nil {
 			return err
 		}
-		if err = currFile.Chown(uid, gid); err != nil {
+		if err := meta.relabel(path); err != nil {
 			return err
 		}
-		currFile.Close()
-	case tar.TypeDir:
-		if err := os.MkdirAll(path, mode); err != nil {
+		if err := os.Chtimes(path, atime, hdr.ModTime); err != nil {
 			return err
 		}
-		// In some cases, MkdirAll doesn't change the permissions, so run Chmod
-		if err := os.Chmod(path, mode); err != nil {
+		s.keep(path, linkPath)
+	case tar.TypeDir:
+		// A lower layer may have a non-directory at path
+		if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return errors.Wrapf(err, "error removing %s to make way for new directory", hdr.Name)
+			}
+		}
+		// Keep the directory writable by us until extraction is done, the
+		// real mode, owner and timestamps are applied by setDirMetadata
+		if err := os.MkdirAll(path, 0755); err != nil {
 			return err
 		}
-		if err := os.Chown(path, uid, gid); err != nil {
+		// In some cases, MkdirAll doesn't change the permissions, so run Chmod
+		if err := os.Chmod(path, mode.Perm()|0700); err != nil {
 			return err
 		}
+		dirs[path] = meta
 
 	// Hard link: Two files point to same data on disc.  Assume OFS/Docker orders tarball such
 	// that hard link comes after regular file that hard link points to.
@@ -85,13 +133,14 @@ func extractFile(dest string, hdr *tar.Header, tr io.Reader, subuid int, subgid
 		}
 		// Check if something already exists at path
 		// If so, delete it
-		if _, err := os.Lstat(path); !os.IsNotExist(err) {
-			if err := os.RemoveAll(path); err != nil {
-				return errors.Wrapf(err, "error removing %s to make way for new link", hdr.Name)
-			}
+		if err := replacePath(path, dirs); err != nil {
+			return errors.Wrapf(err, "error removing %s to make way for new link", hdr.Name)
+		}
+		// Link hard link to its target, which is in dest too
+		link, err := securePath(dest, hdr.Linkname)
+		if err != nil {
+			return err
 		}
-		// Link hard link to its target
-		link := filepath.Clean(filepath.Join(dest, hdr.Linkname))
 		if err := os.Link(link, path); err != nil {
 			return err
 		}
@@ -103,57 +152,131 @@ func extractFile(dest string, hdr *tar.Header, tr io.Reader, subuid int, subgid
 		}
 		// Check if something already exists at path
 		// If so, delete it
-		if _, err := os.Lstat(path); !os.IsNotExist(err) {
-			if err := os.RemoveAll(path); err != nil {
-				return errors.Wrapf(err, "error removing %s to make way for new symlink", hdr.Name)
-			}
+		if err := replacePath(path, dirs); err != nil {
+			return errors.Wrapf(err, "error removing %s to make way for new symlink", hdr.Name)
 		}
 		if err := os.Symlink(hdr.Linkname, path); err != nil {
 			return err
 		}
-		if err := os.Lchown(path, uid, gid); err != nil {
+		if err := meta.chown(path); err != nil {
+			return err
+		}
+		if err := meta.relabel(path); err != nil {
+			return err
+		}
+		if err := lchtimes(path, atime, hdr.ModTime); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Whiteouts
-func whiteout(tr *tar.Reader, rootfs string) error {
-	// Iterate through headers, removing whiteouts first
-	for {
-		hdr, err := tr.Next()
-		// Done with this tar layer
-		if err == io.EOF {
-			break
+// replacePath removes whatever is at path, forgetting the metadata of the
+// directories under it, which setDirMetadata would otherwise apply through
+// whatever replaces them
+func replacePath(path string, dirs map[string]dirMeta) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if err == nil && fi.IsDir() {
+		forgetDirs(dirs, path)
+	}
+	return nil
+}
+
+// headerMeta is the metadata of an entry, owned as o says
+func headerMeta(hdr *tar.Header, o owner) (dirMeta, error) {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	uid, gid := o.names.ids(hdr)
+	meta := dirMeta{
+		mode:     hdr.FileInfo().Mode(),
+		uid:      uid,
+		gid:      gid,
+		atime:    atime,
+		mtime:    hdr.ModTime,
+		rootless: o.rootless,
+		label:    headerLabel(hdr, o),
+	}
+	// The image's own ownership is recorded as is
+	if o.rootless {
+		return meta, nil
+	}
+	var err error
+	if meta.uid, err = mapID(o.uids, uid, o.overflow, o.overflowUID, "uid", hdr.Name); err != nil {
+		return meta, err
+	}
+	if meta.gid, err = mapID(o.gids, gid, o.overflow, o.overflowGID, "gid", hdr.Name); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+// root is the host uid and gid of the container's root, who owns the top
+// directory
+func (o owner) root() (int, int) {
+	if o.rootless {
+		return os.Getuid(), os.Getgid()
+	}
+	uid, _ := o.uids.toHost(0)
+	gid, _ := o.gids.toHost(0)
+	return uid, gid
+}
+
+// setDirMetadata applies the deferred directory metadata, deepest directories
+// first so that a parent's mode and timestamps are set after its children
+func setDirMetadata(dirs map[string]dirMeta) error {
+	paths := make([]string, 0, len(dirs))
+	for path := range dirs {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		di := strings.Count(paths[i], string(os.PathSeparator))
+		dj := strings.Count(paths[j], string(os.PathSeparator))
+		if di != dj {
+			return di > dj
+		}
+		return paths[i] < paths[j]
+	})
+	for _, path := range paths {
+		// The directory may have been whited out or replaced by a later layer
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+			continue
 		}
-		// Something went wrong
 		if err != nil {
 			return err
 		}
-		path := filepath.Join(rootfs, filepath.Clean(hdr.Name))
-		base := filepath.Base(path)
-		dir := filepath.Dir(path)
-		// Opaque directory
-		if strings.HasPrefix(base, ".wh..wh..opq") {
-			if err := os.RemoveAll(dir); err != nil {
-				return errors.Wrapf(err, "removing whiteout %s", hdr.Name)
-			}
-		} else if strings.HasPrefix(base, ".wh.") {
-			name := strings.TrimPrefix(base, ".wh.")
-			if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
-				return errors.Wrapf(err, "removing whiteout %s", hdr.Name)
-			}
-		} else {
-			continue
+		meta := dirs[path]
+		if err := meta.chown(path); err != nil {
+			return err
+		}
+		if err := meta.chmod(path); err != nil {
+			return err
+		}
+		if err := meta.relabel(path); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, meta.atime, meta.mtime); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// Handle regular files
-func handleFiles(tr *tar.Reader, rootfs string, subuid int, subgid int) error {
-	// Iterate through the headers, extracting regular files
+// Handle the files of a layer in a single pass, applying whiteouts to the
+// lower layers as they come up. Entries which f filters out are skipped, but
+// whiteouts are always applied.
+func handleFiles(tr *tar.Reader, rootfs string, o owner, dirs map[string]dirMeta, f *filter, s *contentStore, l *limiter) error {
+	// Paths added by this layer, relative to the rootfs
+	added := make(map[string]bool)
+	f.startLayer()
 	for {
 		hdr, err := tr.Next()
 		// Done with this tar layer
@@ -164,59 +287,57 @@ func handleFiles(tr *tar.Reader, rootfs string, subuid int, subgid int) error {
 		if err != nil {
 			return err
 		}
-		path := filepath.Join(rootfs, filepath.Clean(hdr.Name))
-		base := filepath.Base(path)
-		// This is a whiteout file/directory, skip!
-		if strings.HasPrefix(base, ".wh.") {
+		if err := l.check(hdr); err != nil {
+			return err
+		}
+		// aufs metadata, not part of the rootfs
+		if isWhiteoutMeta(hdr.Name) {
+			log.Debugf("Skipping whiteout metadata %s", hdr.Name)
 			continue
 		}
-		if err := extractFile(rootfs, hdr, tr, subuid, subgid); err != nil {
+		// This is a whiteout file/directory
+		if isWhiteout(filepath.Base(filepath.Clean(hdr.Name))) {
+			if err := whiteout(rootfs, hdr, added, dirs); err != nil {
+				return err
+			}
+			f.whiteout(rootfs, hdr)
+			o.names.changed(hdr.Name)
+			continue
+		}
+		path, err := securePath(rootfs, hdr.Name)
+		if err != nil {
 			return err
 		}
+		// Hard links to filtered out files can't be created either, but
+		// what lower layers have at their path is still replaced
+		if hdr.Typeflag == tar.TypeLink && f.includes(hdr.Name) && !f.includes(hdr.Linkname) {
+			log.Debugf("Removing %s, a link to the filtered out %s", hdr.Name, hdr.Linkname)
+			if err := replacePath(path, dirs); err != nil {
+				return err
+			}
+		}
+		if !f.includes(hdr.Name) || (hdr.Typeflag == tar.TypeLink && !f.includes(hdr.Linkname)) {
+			meta, err := headerMeta(hdr, o)
+			if err != nil {
+				return err
+			}
+			f.skip(hdr, path, meta, dirs)
+			continue
+		}
+		markAdded(added, filepath.Join("/", hdr.Name))
+		f.addParents(rootfs, path, dirs)
+		if err := extractFile(rootfs, hdr, tr, o, dirs, s); err != nil {
+			return err
+		}
+		f.extracted(hdr, path)
+		o.names.changed(hdr.Name)
 	}
 	return nil
 }
 
-// Get a tar reader from a v1.Layer
-func tarReader(layer_file *os.File) (*tar.Reader, error) {
-	r, err := v1util.GunzipReadCloser(layer_file)
-	if err != nil {
-		return nil, err
-	}
-	tr := tar.NewReader(r)
-	return tr, nil
-}
-
-// saveLayer saves a Layer to disk
-func saveLayer(layer v1.Layer) (*os.File, error) {
-	digest, err := layer.Digest()
-	if err != nil {
-		return nil, err
-	}
-
-	layer_file, err := ioutil.TempFile("", fmt.Sprintf("%s", digest))
-	if err != nil {
-		return nil, errors.Wrapf(err, "generating tempfile")
-	}
-
-	rc, err := layer.Compressed()
-	if err != nil {
-		defer os.Remove(layer_file.Name())
-		return nil, err
-	}
-
-	_, err = io.Copy(layer_file, rc)
-	if err != nil {
-		defer os.Remove(layer_file.Name())
-		return nil, err
-	}
-	layer_file.Seek(0, 0)
-	return layer_file, nil
-}
-
-// extractLayer accepts an open file descriptor to tarball and the destianation
-// to extract the rootfs to
-func extractLayer(layer v1.Layer, rootfs string, subuid int, subgid int) error {
+// extractLayer streams a layer from the registry, decompresses it and hands
+// the tar stream to apply. The compression ratio is checked with l.
+func extractLayer(layer v1.Layer, l *limiter, apply func(*tar.Reader) error) error {
 	digest, err := layer.Digest()
 	if err != nil {
 		return err
@@ -226,33 +347,31 @@ func extractLayer(layer v1.Layer, rootfs string, subuid int, subgid int) error {
 		return err
 	}
 
-	log.Debugf("Downloading layer %s, %d bytes", digest, size)
-	layer_file, err := saveLayer(layer)
-	if err != nil {
-		return err
-	}
-	defer os.Remove(layer_file.Name())
-
-	tr, err := tarReader(layer_file)
+	log.Debugf("Extracting layer %s, %d bytes", digest, size)
+	rc, err := layer.Compressed()
 	if err != nil {
 		return err
 	}
-	log.Debugf("Whiting out layer %s", digest)
-	err = whiteout(tr, rootfs)
+	defer rc.Close()
+	gz, err := v1util.GunzipReadCloser(ioutil.NopCloser(l.startLayer(digest.String(), rc)))
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "decompressing layer %s", digest)
 	}
+	defer gz.Close()
+	r := l.uncompressed(gz)
 
-	layer_file.Seek(0, 0)
-	tr, err = tarReader(layer_file)
+	err = apply(tar.NewReader(r))
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "extracting layer %s", digest)
 	}
-
-	log.Debugf("Extracting layer %s", digest)
-	err = handleFiles(tr, rootfs, subuid, subgid)
+	// Drain the rest of the stream (tar padding, gzip footer) so that the
+	// layer digest is verified, but not a bomb hidden after the tar
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(r, maxTrailingBytes+1))
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "reading layer %s", digest)
+	}
+	if n > maxTrailingBytes {
+		return errors.Errorf("layer %s has more than %d bytes after the end of its tar", digest, maxTrailingBytes)
 	}
 	return nil
 }
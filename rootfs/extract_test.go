@@ -0,0 +1,112 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+)
+
+// tarBytes builds a layer tar from the given headers. Regular files get their
+// content from contents, keyed by name.
+func tarBytes(t *testing.T, hdrs []*tar.Header, contents map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(contents[hdr.Name]))
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(contents[hdr.Name]))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// buildTar builds an in-memory layer from the given headers
+func buildTar(t *testing.T, hdrs []*tar.Header, contents map[string]string) *tar.Reader {
+	return tar.NewReader(bytes.NewReader(tarBytes(t, hdrs, contents)))
+}
+
+// testLayer builds a v1.Layer from the given headers
+func testLayer(t *testing.T, hdrs []*tar.Header, contents map[string]string) v1.Layer {
+	data := tarBytes(t, hdrs, contents)
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	require.NoError(t, err)
+	return layer
+}
+
+// testImage builds a v1.Image from the given layers
+func testImage(t *testing.T, layers ...v1.Layer) v1.Image {
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	require.NoError(t, err)
+	return img
+}
+
+// testOwner keeps the files owned by us
+func testOwner() owner {
+	return owner{uids: offsetMap(os.Getuid()), gids: offsetMap(os.Getgid())}
+}
+
+// testPulledImage is a PulledImage of img to extract with spec, with the IDs
+// mapped like testOwner
+func testPulledImage(t *testing.T, img v1.Image, spec Spec) *PulledImage {
+	spec.uidMap, spec.gidMap = offsetMap(os.Getuid()), offsetMap(os.Getgid())
+	return &PulledImage{img: img, name: "test", spec: spec}
+}
+
+// Test that a read-only directory still gets its children, and that its
+// mode and timestamps are applied at the end
+func TestReadOnlyDirectory(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	mtime := time.Unix(1500000000, 0)
+	hdrs := []*tar.Header{
+		{Name: "ro/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: mtime},
+		{Name: "ro/sub/", Typeflag: tar.TypeDir, Mode: 0000, ModTime: mtime},
+		{Name: "ro/sub/file", Typeflag: tar.TypeReg, Mode: 0444, ModTime: mtime},
+		{Name: "ro/link", Typeflag: tar.TypeSymlink, Linkname: "sub/file", ModTime: mtime},
+	}
+	tr := buildTar(t, hdrs, map[string]string{"ro/sub/file": "hello"})
+
+	dirs := make(map[string]dirMeta)
+	require.NoError(t, handleFiles(tr, rootfs, testOwner(), dirs, nil, nil, nil))
+	require.NoError(t, setDirMetadata(dirs))
+	defer filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+
+	fi, err := os.Stat(filepath.Join(rootfs, "ro"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0555), fi.Mode().Perm())
+	require.True(t, mtime.Equal(fi.ModTime()))
+
+	fi, err = os.Stat(filepath.Join(rootfs, "ro/sub"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0000), fi.Mode().Perm())
+	require.True(t, mtime.Equal(fi.ModTime()))
+
+	fi, err = os.Lstat(filepath.Join(rootfs, "ro/sub/file"))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), fi.Size())
+}
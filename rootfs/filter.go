@@ -0,0 +1,186 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// filter decides which entries of the layers are extracted, from the
+// Spec.Include and Spec.Exclude globs, and keeps count of what was skipped.
+// A nil filter extracts everything.
+type filter struct {
+	include []string
+	exclude []string
+	// Metadata of the directories which were filtered out, keyed by their
+	// path in the rootfs, in case they turn out to be the parents of
+	// included entries
+	parents map[string]dirMeta
+	// Directories filtered out by the current layer
+	layerParents map[string]bool
+	stats        extractStats
+}
+
+// extractStats counts the entries of the layers, and their size
+type extractStats struct {
+	extracted      int
+	extractedBytes int64
+	// Disk space used by the extracted files, less than extractedBytes
+	// when they have holes
+	allocatedBytes int64
+	skipped        int
+	skippedBytes   int64
+}
+
+// since is what was counted after before
+func (s extractStats) since(before extractStats) extractStats {
+	return extractStats{
+		extracted:      s.extracted - before.extracted,
+		extractedBytes: s.extractedBytes - before.extractedBytes,
+		allocatedBytes: s.allocatedBytes - before.allocatedBytes,
+		skipped:        s.skipped - before.skipped,
+		skippedBytes:   s.skippedBytes - before.skippedBytes,
+	}
+}
+
+// newFilter validates the globs and returns a filter for them
+func newFilter(include []string, exclude []string) (*filter, error) {
+	f := &filter{parents: make(map[string]dirMeta)}
+	var err error
+	if f.include, err = cleanPatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = cleanPatterns(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// cleanPatterns makes the globs absolute and checks that they are valid
+func cleanPatterns(patterns []string) ([]string, error) {
+	cleaned := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = path.Clean("/" + pattern)
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+		cleaned = append(cleaned, pattern)
+	}
+	return cleaned, nil
+}
+
+// matches reports whether a pattern matches name, or one of its parents
+func matches(patterns []string, name string) bool {
+	for ; ; name = path.Dir(name) {
+		for _, pattern := range patterns {
+			// The patterns are valid, see cleanPatterns
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		if name == "/" {
+			return false
+		}
+	}
+}
+
+// includes reports whether name, relative to the rootfs, is extracted
+func (f *filter) includes(name string) bool {
+	if f == nil {
+		return true
+	}
+	name = path.Clean("/" + name)
+	if len(f.include) > 0 && !matches(f.include, name) {
+		return false
+	}
+	return !matches(f.exclude, name)
+}
+
+// startLayer is called before the entries of each layer
+func (f *filter) startLayer() {
+	if f == nil {
+		return
+	}
+	f.layerParents = make(map[string]bool)
+}
+
+// extracted counts an entry which is extracted to path
+func (f *filter) extracted(hdr *tar.Header, path string) {
+	if f == nil {
+		return
+	}
+	f.stats.extracted++
+	if size := entrySize(hdr); size > 0 {
+		f.stats.extractedBytes += size
+		f.stats.allocatedBytes += allocatedSize(path)
+	}
+}
+
+// skip counts an entry which is filtered out. Directories are remembered, so
+// that they are created with the image's metadata if an included entry is
+// under them.
+func (f *filter) skip(hdr *tar.Header, path string, meta dirMeta, dirs map[string]dirMeta) {
+	f.stats.skipped++
+	f.stats.skippedBytes += entrySize(hdr)
+	if hdr.Typeflag != tar.TypeDir {
+		return
+	}
+	f.parents[path] = meta
+	f.layerParents[path] = true
+	// Already created for an earlier included entry, update it
+	if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+		dirs[path] = meta
+	}
+}
+
+// addParents records the metadata of the filtered out parents of path, which
+// extractFile creates for it, so that setDirMetadata applies it
+func (f *filter) addParents(rootfs string, path string, dirs map[string]dirMeta) {
+	if f == nil {
+		return
+	}
+	for dir := filepath.Dir(path); dir != rootfs && strings.HasPrefix(dir, rootfs); dir = filepath.Dir(dir) {
+		if _, ok := dirs[dir]; ok {
+			continue
+		}
+		if meta, ok := f.parents[dir]; ok {
+			dirs[dir] = meta
+		}
+	}
+}
+
+// whiteout drops the filtered out lower layer directories hidden by a
+// whiteout entry, whose metadata must not be applied if included entries
+// recreate them
+func (f *filter) whiteout(rootfs string, hdr *tar.Header) {
+	if f == nil {
+		return
+	}
+	name := filepath.Join(rootfs, hdr.Name)
+	base := filepath.Base(name)
+	hidden := filepath.Dir(name)
+	opaque := base == whiteoutOpaqueDir
+	if !opaque {
+		hidden = filepath.Join(hidden, strings.TrimPrefix(base, whiteoutPrefix))
+	}
+	for dir := range f.parents {
+		if f.layerParents[dir] {
+			continue
+		}
+		if strings.HasPrefix(dir, hidden+string(os.PathSeparator)) || (!opaque && dir == hidden) {
+			delete(f.parents, dir)
+		}
+	}
+}
+
+// entrySize is the size of an entry's content
+func entrySize(hdr *tar.Header) int64 {
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeGNUSparse {
+		return hdr.Size
+	}
+	return 0
+}
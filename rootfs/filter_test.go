@@ -0,0 +1,123 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterIncludes(t *testing.T) {
+	f, err := newFilter([]string{"usr/lib", "/etc/*.conf"}, []string{"/usr/lib/*.a"})
+	require.NoError(t, err)
+	for name, expected := range map[string]bool{
+		"usr/lib":            true,
+		"usr/lib/":           true,
+		"usr/lib/libc.so":    true,
+		"usr/lib/x/libc.a":   true,
+		"usr/lib/libc.a":     false,
+		"usr/":               false,
+		"usr/libexec/x":      false,
+		"etc/resolv.conf":    true,
+		"etc/passwd":         false,
+		"./etc/ld.so.conf/x": true,
+	} {
+		require.Equal(t, expected, f.includes(name), name)
+	}
+
+	_, err = newFilter([]string{"usr/[lib"}, nil)
+	require.Error(t, err)
+
+	// Nothing is filtered out by default
+	var none *filter
+	require.True(t, none.includes("anything"))
+}
+
+// Test that filtered out parents of included entries get their metadata from
+// the image, and that whiteouts are applied to filtered paths
+func TestFilterExtraction(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	f, err := newFilter([]string{"/usr/lib", "/etc"}, []string{"/etc/shadow"})
+	require.NoError(t, err)
+	mtime := time.Unix(1500000000, 0)
+	dirs := make(map[string]dirMeta)
+	lower := buildTar(t, []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime},
+		{Name: "usr/lib/a", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/lib/b", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/lib/sh", Typeflag: tar.TypeLink, Linkname: "bin/sh"},
+		{Name: "usr/share/doc", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		// After its child
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0711, ModTime: mtime},
+	}, map[string]string{"bin/sh": "sh", "usr/lib/a": "a", "usr/lib/b": "b", "usr/share/doc": "doc", "etc/passwd": "root"})
+	require.NoError(t, handleFiles(lower, rootfs, testOwner(), dirs, f, nil, nil))
+
+	upper := buildTar(t, []*tar.Header{
+		{Name: "usr/lib/.wh.a", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+	}, map[string]string{"etc/shadow": "secret"})
+	require.NoError(t, handleFiles(upper, rootfs, testOwner(), dirs, f, nil, nil))
+	require.NoError(t, setDirMetadata(dirs))
+
+	require.Equal(t, map[string]string{
+		"usr":        "/",
+		"usr/lib":    "/",
+		"usr/lib/b":  "b",
+		"etc":        "/",
+		"etc/passwd": "root",
+	}, tree(t, rootfs))
+
+	fi, err := os.Stat(filepath.Join(rootfs, "usr"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+	require.True(t, mtime.Equal(fi.ModTime()))
+	fi, err = os.Stat(filepath.Join(rootfs, "etc"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0711), fi.Mode().Perm())
+
+	// Depends on the filesystem's block size
+	require.True(t, f.stats.allocatedBytes > 0)
+	f.stats.allocatedBytes = 0
+	require.Equal(t, extractStats{
+		extracted:      4,
+		extractedBytes: 6,
+		skipped:        6,
+		skippedBytes:   11,
+	}, f.stats)
+}
+
+// Test that a hard link to a filtered out file doesn't leave what a lower
+// layer has at its path
+func TestFilterExcludedLinkTarget(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	f, err := newFilter(nil, []string{"/bin/busybox"})
+	require.NoError(t, err)
+	dirs := make(map[string]dirMeta)
+	lower := buildTar(t, []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+	}, map[string]string{"bin/sh": "old sh"})
+	require.NoError(t, handleFiles(lower, rootfs, testOwner(), dirs, f, nil, nil))
+
+	upper := buildTar(t, []*tar.Header{
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+	}, map[string]string{"bin/busybox": "busybox"})
+	require.NoError(t, handleFiles(upper, rootfs, testOwner(), dirs, f, nil, nil))
+	require.NoError(t, setDirMetadata(dirs))
+
+	require.Equal(t, map[string]string{"bin": "/"}, tree(t, rootfs))
+}
@@ -0,0 +1,168 @@
+package rootfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ForAllSecure/rootfs_builder/util"
+	"github.com/pkg/errors"
+)
+
+// IDMapping maps a range of container IDs to host IDs, in the same form as
+// the uidMappings and gidMappings of the OCI runtime spec
+type IDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+// Policies for Spec.IDOverflow
+const (
+	// IDOverflowFail fails the extraction
+	IDOverflowFail = "fail"
+	// IDOverflowHost gives the file to the kernel's overflow ID, which is
+	// what an unmapped ID shows up as in a user namespace
+	IDOverflowHost = "overflow"
+	// IDOverflowNobody gives the file to the container's nobody, 65534
+	IDOverflowNobody = "nobody"
+)
+
+// nobodyID is the container ID of nobody and nogroup
+const nobodyID = 65534
+
+// idMap is the list of mappings of either uids or gids
+type idMap []IDMapping
+
+// owner of the extracted files, as the spec asks
+func (pulledImg *PulledImage) owner() owner {
+	o := owner{
+		uids:     pulledImg.spec.uidMap,
+		gids:     pulledImg.spec.gidMap,
+		overflow: pulledImg.spec.IDOverflow,
+		rootless: pulledImg.spec.Rootless,
+		selinux:  pulledImg.spec.SELinux,
+	}
+	if o.overflow == IDOverflowHost {
+		o.overflowUID, o.overflowGID = overflowID("uid"), overflowID("gid")
+	}
+	return o
+}
+
+// offsetMap shifts every ID by hostID
+func offsetMap(hostID int) idMap {
+	return idMap{{ContainerID: 0, HostID: uint32(hostID), Size: math.MaxUint32 - uint32(hostID)}}
+}
+
+// subidMap maps the container IDs, from 0, to the ranges of /etc/subuid or
+// /etc/subgid, in order
+func subidMap(ranges []util.IDRange) idMap {
+	var m idMap
+	containerID := uint32(0)
+	for _, r := range ranges {
+		m = append(m, IDMapping{ContainerID: containerID, HostID: uint32(r.Start), Size: uint32(r.Size)})
+		containerID += uint32(r.Size)
+	}
+	return m
+}
+
+// size is the number of container IDs which are mapped
+func (m idMap) size() uint64 {
+	var size uint64
+	for _, mapping := range m {
+		size += uint64(mapping.Size)
+	}
+	return size
+}
+
+// validate checks that the mappings don't overlap, on either side
+func (m idMap) validate() error {
+	for i, a := range m {
+		if a.Size == 0 {
+			return errors.Errorf("empty mapping %s", a)
+		}
+		if uint64(a.ContainerID)+uint64(a.Size) > math.MaxUint32 || uint64(a.HostID)+uint64(a.Size) > math.MaxUint32 {
+			return errors.Errorf("mapping %s goes past the largest ID", a)
+		}
+		for _, b := range m[i+1:] {
+			if overlaps(a.ContainerID, b.ContainerID, a.Size, b.Size) || overlaps(a.HostID, b.HostID, a.Size, b.Size) {
+				return errors.Errorf("mappings %s and %s overlap", a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// overlaps reports whether the ranges starting at a and b overlap
+func overlaps(a uint32, b uint32, aSize uint32, bSize uint32) bool {
+	return uint64(a) < uint64(b)+uint64(bSize) && uint64(b) < uint64(a)+uint64(aSize)
+}
+
+// toHost maps a container ID to its host ID
+func (m idMap) toHost(id int) (int, bool) {
+	for _, mapping := range m {
+		if id >= int(mapping.ContainerID) && uint64(id) < uint64(mapping.ContainerID)+uint64(mapping.Size) {
+			return int(mapping.HostID) + id - int(mapping.ContainerID), true
+		}
+	}
+	return 0, false
+}
+
+// toContainer maps a host ID back to its container ID
+func (m idMap) toContainer(id int) (int, bool) {
+	for _, mapping := range m {
+		if id >= int(mapping.HostID) && uint64(id) < uint64(mapping.HostID)+uint64(mapping.Size) {
+			return int(mapping.ContainerID) + id - int(mapping.HostID), true
+		}
+	}
+	return 0, false
+}
+
+func (mapping IDMapping) String() string {
+	return fmt.Sprintf("%d:%d:%d", mapping.ContainerID, mapping.HostID, mapping.Size)
+}
+
+func (m idMap) String() string {
+	parts := make([]string, len(m))
+	for i, mapping := range m {
+		parts[i] = mapping.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// mapID maps a container uid or gid of the file name to the host, applying
+// the overflow policy if it isn't mapped. overflow is the kernel's overflow
+// ID, for IDOverflowHost.
+func mapID(m idMap, id int, policy string, overflow int, kind string, name string) (int, error) {
+	if host, ok := m.toHost(id); ok {
+		return host, nil
+	}
+	switch policy {
+	case "", IDOverflowFail:
+		return 0, errors.Errorf("%s %d of %s is outside of the %s mappings %s", kind, id, name, kind, m)
+	case IDOverflowHost:
+		return overflow, nil
+	case IDOverflowNobody:
+		if host, ok := m.toHost(nobodyID); ok {
+			return host, nil
+		}
+		return 0, errors.Errorf("%s %d of %s is outside of the %s mappings %s, and so is nobody", kind, id, name, kind, m)
+	default:
+		return 0, errors.Errorf("unknown ID overflow policy %q", policy)
+	}
+}
+
+// overflowID is the kernel's overflow uid or gid, 65534 unless configured
+func overflowID(kind string) int {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/overflow" + kind)
+	if err != nil {
+		return nobodyID
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nobodyID
+	}
+	return id
+}
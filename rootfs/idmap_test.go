@@ -0,0 +1,89 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"testing"
+
+	"github.com/ForAllSecure/rootfs_builder/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDMap(t *testing.T) {
+	// Two subuid ranges, as when one is too small
+	m := subidMap([]util.IDRange{{Start: 100000, Size: 1000}, {Start: 300000, Size: 65536}})
+	require.Equal(t, idMap{
+		{ContainerID: 0, HostID: 100000, Size: 1000},
+		{ContainerID: 1000, HostID: 300000, Size: 65536},
+	}, m)
+	require.NoError(t, m.validate())
+	require.Equal(t, uint64(66536), m.size())
+
+	for _, ids := range [][2]int{{0, 100000}, {999, 100999}, {1000, 300000}, {65534, 364534}} {
+		host, ok := m.toHost(ids[0])
+		require.True(t, ok)
+		require.Equal(t, ids[1], host)
+		container, ok := m.toContainer(ids[1])
+		require.True(t, ok)
+		require.Equal(t, ids[0], container)
+	}
+	_, ok := m.toHost(66536)
+	require.False(t, ok)
+	_, ok = m.toContainer(101000)
+	require.False(t, ok)
+
+	require.Error(t, idMap{{ContainerID: 0, HostID: 0, Size: 10}, {ContainerID: 5, HostID: 100, Size: 10}}.validate())
+	require.Error(t, idMap{{ContainerID: 0, HostID: 0, Size: 10}, {ContainerID: 10, HostID: 5, Size: 10}}.validate())
+	require.Error(t, idMap{{ContainerID: 0, HostID: 0, Size: 0}}.validate())
+	require.NoError(t, offsetMap(1000).validate())
+}
+
+func TestIDOverflow(t *testing.T) {
+	m := idMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	hdr := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 70000, Gid: 1}
+
+	_, err := headerMeta(hdr, owner{uids: m, gids: m})
+	require.Error(t, err)
+	_, err = headerMeta(hdr, owner{uids: m, gids: m, overflow: IDOverflowFail})
+	require.Error(t, err)
+
+	meta, err := headerMeta(hdr, owner{uids: m, gids: m, overflow: IDOverflowHost, overflowUID: 65533})
+	require.NoError(t, err)
+	require.Equal(t, 65533, meta.uid)
+	o := (&PulledImage{spec: Spec{IDOverflow: IDOverflowHost}}).owner()
+	require.Equal(t, overflowID("uid"), o.overflowUID)
+	require.Equal(t, overflowID("gid"), o.overflowGID)
+	require.Equal(t, 100001, meta.gid)
+
+	meta, err = headerMeta(hdr, owner{uids: m, gids: m, overflow: IDOverflowNobody})
+	require.NoError(t, err)
+	require.Equal(t, 100000+nobodyID, meta.uid)
+
+	small := idMap{{ContainerID: 0, HostID: 100000, Size: 1000}}
+	_, err = headerMeta(hdr, owner{uids: small, gids: small, overflow: IDOverflowNobody})
+	require.Error(t, err)
+}
+
+func TestValidateUserMappings(t *testing.T) {
+	pulledImg := &PulledImage{spec: Spec{
+		User:        "root",
+		Group:       "root",
+		UIDMappings: []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}}
+	require.NoError(t, pulledImg.validateUser())
+	require.Equal(t, idMap{{ContainerID: 0, HostID: 100000, Size: 65536}}, pulledImg.spec.uidMap)
+	require.Equal(t, idMap{{ContainerID: 0, HostID: 200000, Size: 65536}}, pulledImg.spec.gidMap)
+
+	// The runtime needs both, so the other isn't derived from Group
+	pulledImg.spec.GIDMappings = nil
+	require.Error(t, pulledImg.validateUser())
+	pulledImg.spec.GIDMappings = pulledImg.spec.UIDMappings
+
+	// Root must be mapped, for the top directory
+	pulledImg.spec.UIDMappings = []IDMapping{{ContainerID: 1, HostID: 100000, Size: 65535}}
+	require.Error(t, pulledImg.validateUser())
+
+	pulledImg.spec.UIDMappings, pulledImg.spec.GIDMappings = nil, nil
+	pulledImg.spec.IDOverflow = "clamp"
+	require.Error(t, pulledImg.validateUser())
+}
@@ -1,13 +1,16 @@
 package rootfs
 
 import (
+	"archive/tar"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 
+	"github.com/ForAllSecure/rootfs_builder/log"
 	"github.com/ForAllSecure/rootfs_builder/util"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -15,16 +18,95 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Output modes for Spec.Output
+const (
+	// OutputRootfs flattens all layers into Dest/rootfs
+	OutputRootfs = "rootfs"
+	// OutputOverlay extracts each layer into Dest/layers/<diff_id> for use
+	// as overlayfs lower directories
+	OutputOverlay = "overlay"
+	// OutputTar writes the flattened rootfs as a tar, see Spec.Export
+	OutputTar = "tar"
+	// OutputImage writes the flattened rootfs as a single layer image, see
+	// Spec.Export
+	OutputImage = "image"
+)
+
 // Spec for rootfs extraction
 type Spec struct {
 	// Destination to extract to
 	Dest string
+	// Output mode, OutputRootfs by default
+	Output string
 	// User to chown files in rootfs to
 	User string
+	// Group to chown files in rootfs to, instead of the user's primary group
+	Group string
 	// Use the subuid associated with the given user for chowning
 	UseSubuid bool
-	subuid    int
-	subgid    int
+	// Mappings of the image's uids and gids to the host's, instead of the
+	// ones from User, Group and UseSubuid
+	UIDMappings []IDMapping
+	GIDMappings []IDMapping
+	// What to do with IDs outside of the mappings, IDOverflowFail by
+	// default
+	IDOverflow string
+	// Resolve ownership through the user and group names of the layers,
+	// with Names and the image's /etc/passwd and /etc/group, rather than
+	// their numeric IDs
+	OwnerByName bool
+	// Names to resolve before the image's, for OwnerByName
+	Names Names
+	// Keep the files owned by the invoking user, and record the image's
+	// ownership in the user.rootlesscontainers xattr, so that no privileges
+	// are needed. Can't be used with User or UseSubuid.
+	Rootless bool
+	// Where and how to write the tar for OutputTar, or the image for
+	// OutputImage
+	Export Export
+	// Overrides for the generated runtime config.json
+	Runtime Runtime
+	// Directory to keep snapshots of the rootfs in, so that images sharing
+	// layers don't extract them again. A snapshot is saved of the whole
+	// chain of layers, and of the layers shared with the previous image
+	// when they branch.
+	Snapshots string
+	// Globs of the paths to extract, e.g. /usr/lib or /etc/*.conf. A glob
+	// matching a directory matches everything under it. Everything is
+	// extracted by default.
+	Include []string
+	// Globs of the paths not to extract, even if Include matches them
+	Exclude []string
+	// Write a manifest of Dest/rootfs to Dest/rootfs.mtree, which
+	// VerifyManifest checks the rootfs against
+	Manifest bool
+	// What to do when Dest isn't empty, ConflictMerge by default
+	Conflict string
+	// Directory of a store shared between rootfs trees, keeping the
+	// content of regular files by sha256. Files are reflinked from it when
+	// the filesystem supports it, and copied otherwise.
+	Store string
+	// Hard link the files with the same content and metadata to a single
+	// file of the store, rather than copying them. The rootfs trees must
+	// then not be modified in place, as files are shared between them.
+	StoreHardlinks bool
+	// SELinux labels of the extracted files
+	SELinux SELinux
+	// Limits on what the layers can extract, for untrusted images
+	Limits Limits
+	// Local tarballs, optionally gzipped, or directories to apply as
+	// layers on top of the image's, in order
+	ExtraLayers []string
+	// Files, directories and tarballs to add to the rootfs after the last
+	// layer
+	Inject []Inject
+	// Don't check that there is enough disk space before extracting
+	SkipPreflight bool
+	// Keep the staging directory the rootfs is built in when extraction
+	// fails, for debugging
+	KeepStaging bool
+	uidMap      idMap
+	gidMap      idMap
 }
 
 // PulledImage using provided PullableImage
@@ -63,51 +145,177 @@ func (pulledImg *PulledImage) Extract() error {
 	if err != nil {
 		return err
 	}
-
-	// Dump the config
-	err = pulledImg.writeConfig()
+	lock, err := lockDest(pulledImg.spec.Dest)
 	if err != nil {
 		return err
 	}
+	defer lock.Close()
 
 	// Get a list of layers
-	layers, err := pulledImg.img.Layers()
+	layers, err := pulledImg.layers()
 	if err != nil {
 		return err
 	}
 
-	rootfsPath := filepath.Join(pulledImg.spec.Dest, "rootfs")
-	if err := os.MkdirAll(rootfsPath, 0755); err != nil {
+	if err := pulledImg.validateUser(); err != nil {
+		return err
+	}
+	if _, err := newFilter(pulledImg.spec.Include, pulledImg.spec.Exclude); err != nil {
+		return err
+	}
+	if err := pulledImg.validateInject(); err != nil {
+		return err
+	}
+	if err := pulledImg.validateOutput(); err != nil {
 		return err
 	}
 
-	if err := pulledImg.validateUser(); err != nil {
+	// Only touch Dest once the spec is known to be valid
+	if err := pulledImg.resolveConflict(); err != nil {
+		return err
+	}
+	if !pulledImg.spec.SkipPreflight {
+		if err := pulledImg.preflight(layers); err != nil {
+			return err
+		}
+	}
+
+	// Dump the config
+	err = pulledImg.writeConfig()
+	if err != nil {
 		return err
 	}
 
-	// Extract the layers
-	for _, layer := range layers {
-		err = extractLayer(layer, rootfsPath, pulledImg.spec.subuid, pulledImg.spec.subgid)
+	switch pulledImg.spec.Output {
+	case "", OutputRootfs:
+		return pulledImg.extractRootfs(layers)
+	case OutputOverlay:
+		return pulledImg.extractOverlay(layers)
+	case OutputTar:
+		return pulledImg.exportTar(layers)
+	case OutputImage:
+		return pulledImg.exportImage(layers)
+	default:
+		return errors.Errorf("unknown output mode %q", pulledImg.spec.Output)
+	}
+}
+
+// validateOutput checks the settings of the output mode, before Dest is
+// touched
+func (pulledImg *PulledImage) validateOutput() error {
+	switch pulledImg.spec.Output {
+	case "", OutputRootfs:
+		return nil
+	case OutputOverlay:
+		// Layer directories are shared between images, so they are whole
+		if len(pulledImg.spec.Include) > 0 || len(pulledImg.spec.Exclude) > 0 {
+			return errors.New("Include and Exclude aren't supported with the overlay output")
+		}
+		if len(pulledImg.spec.Inject) > 0 {
+			return errors.New("Inject isn't supported with the overlay output")
+		}
+		return nil
+	case OutputTar:
+		return pulledImg.validateTarExport()
+	case OutputImage:
+		return pulledImg.validateImageExport()
+	default:
+		return errors.Errorf("unknown output mode %q", pulledImg.spec.Output)
+	}
+}
+
+// flatten extracts the layers on top of each other into rootfsPath, a tree
+// to export. The store isn't used: the files it hard links together would be
+// exported as hard links.
+func (pulledImg *PulledImage) flatten(layers []v1.Layer, rootfsPath string) error {
+	flat := *pulledImg
+	flat.spec.Store = ""
+	return flat.flattenFrom(layers, rootfsPath, make(map[string]dirMeta), nil)
+}
+
+// flattenFrom extracts the layers on top of the rootfs at rootfsPath, whose
+// directories' metadata is in dirs. afterLayer, if set, is called with the
+// index of each layer and what was extracted from it once it is extracted.
+func (pulledImg *PulledImage) flattenFrom(layers []v1.Layer, rootfsPath string, dirs map[string]dirMeta, afterLayer func(int, extractStats) error) error {
+	o := pulledImg.owner()
+	if pulledImg.spec.OwnerByName {
+		o.names = newNameResolver(rootfsPath, pulledImg.spec.Names)
+	}
+	f, err := newFilter(pulledImg.spec.Include, pulledImg.spec.Exclude)
+	if err != nil {
+		return err
+	}
+	s, err := pulledImg.contentStore()
+	if err != nil {
+		return err
+	}
+	l := newLimiter(pulledImg.spec.Limits)
+	for i, layer := range layers {
+		before := f.stats
+		err := extractLayer(layer, l, func(tr *tar.Reader) error {
+			return handleFiles(tr, rootfsPath, o, dirs, f, s, l)
+		})
 		if err != nil {
 			return err
 		}
+		if afterLayer != nil {
+			if err := afterLayer(i, f.stats.since(before)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := pulledImg.inject(rootfsPath, o, dirs, s); err != nil {
+		return err
 	}
 
-	if err := os.Chown(rootfsPath, pulledImg.spec.subuid, pulledImg.spec.subuid); err != nil {
+	// Now that every file is in place, lock down the directories
+	if err := setDirMetadata(dirs); err != nil {
 		return err
 	}
 
+	if !o.rootless {
+		uid, gid := o.root()
+		if err := os.Chown(rootfsPath, uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := setLabel(rootfsPath, o.selinux.Label); err != nil {
+		return err
+	}
+
+	log.Infof("Extracted %d entries, %d bytes (%d allocated); skipped %d entries, %d bytes",
+		f.stats.extracted, f.stats.extractedBytes, f.stats.allocatedBytes, f.stats.skipped, f.stats.skippedBytes)
+	o.names.report()
+	s.report()
 	return nil
 }
 
-// Confirm that the user exists, and look up the appropriate subuid/subgid
+// Confirm that the user exists, and set up the mappings of the image's uids
+// and gids
 func (pulledImg *PulledImage) validateUser() error {
+	spec := &pulledImg.spec
+	switch spec.IDOverflow {
+	case "", IDOverflowFail, IDOverflowHost, IDOverflowNobody:
+	default:
+		return errors.Errorf("unknown ID overflow policy %q", spec.IDOverflow)
+	}
+
+	// The image's ownership is recorded as is
+	if spec.Rootless {
+		if spec.User != "" || spec.Group != "" || spec.UseSubuid || len(spec.UIDMappings) > 0 || len(spec.GIDMappings) > 0 {
+			return errors.New("User, Group, UseSubuid and mappings can't be used with Rootless")
+		}
+		spec.uidMap, spec.gidMap = offsetMap(0), offsetMap(0)
+		return nil
+	}
+
 	// Default to current user
 	userObj, err := user.Current()
 
 	// The config provided a user
-	if pulledImg.spec.User != "" {
-		userObj, err = user.Lookup(pulledImg.spec.User)
+	if spec.User != "" {
+		userObj, err = user.Lookup(spec.User)
 	}
 
 	// Failed to find the user
@@ -115,25 +323,63 @@ func (pulledImg *PulledImage) validateUser() error {
 		return err
 	}
 
-	// Get subuids for user namespace
-	subuid, err := strconv.Atoi(userObj.Uid)
+	uid, err := strconv.Atoi(userObj.Uid)
 	if err != nil {
 		return err
 	}
-	subgid, err := strconv.Atoi(userObj.Gid)
+	gid, err := strconv.Atoi(userObj.Gid)
 	if err != nil {
 		return err
 	}
-	if pulledImg.spec.UseSubuid {
-		subuid, subgid, err = util.GetSubid(userObj)
+	if spec.Group != "" {
+		groupObj, err := user.LookupGroup(spec.Group)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			groupObj, err = user.LookupGroupId(spec.Group)
+		}
 		if err != nil {
 			return err
 		}
+		if gid, err = strconv.Atoi(groupObj.Gid); err != nil {
+			return err
+		}
+		userObj.Gid = groupObj.Gid
 	}
+	spec.uidMap, spec.gidMap = offsetMap(uid), offsetMap(gid)
 
-	pulledImg.spec.subuid = subuid
-	pulledImg.spec.subgid = subgid
+	// Get subuids for user namespace
+	if spec.UseSubuid {
+		subuids, subgids, err := util.GetSubidRanges(userObj)
+		if err != nil {
+			return err
+		}
+		spec.uidMap, spec.gidMap = subidMap(subuids), subidMap(subgids)
+		for kind, m := range map[string]idMap{"subuid": spec.uidMap, "subgid": spec.gidMap} {
+			if m.size() < util.MapSize {
+				log.Warnf("The %s ranges of %s only map %d IDs", kind, userObj.Username, m.size())
+			}
+		}
+	}
 
+	// Both are written to config.json, where an offset map isn't valid
+	if (len(spec.UIDMappings) > 0) != (len(spec.GIDMappings) > 0) {
+		return errors.New("set both UIDMappings and GIDMappings, or neither")
+	}
+	if len(spec.UIDMappings) > 0 {
+		spec.uidMap, spec.gidMap = spec.UIDMappings, spec.GIDMappings
+	}
+	if err := spec.uidMap.validate(); err != nil {
+		return errors.Wrap(err, "invalid uid mappings")
+	}
+	if err := spec.gidMap.validate(); err != nil {
+		return errors.Wrap(err, "invalid gid mappings")
+	}
+	// The top directory belongs to root
+	if _, ok := spec.uidMap.toHost(0); !ok {
+		return errors.New("uid mappings don't map root")
+	}
+	if _, ok := spec.gidMap.toHost(0); !ok {
+		return errors.New("gid mappings don't map root")
+	}
 	return nil
 }
 
@@ -142,6 +388,11 @@ func (pulledImg *PulledImage) validateDest() error {
 	if pulledImg.spec.Dest == "" {
 		return errors.New("Specify output destination for rootfs")
 	}
+	switch pulledImg.spec.Conflict {
+	case "", ConflictFail, ConflictReplace, ConflictMerge:
+	default:
+		return errors.Errorf("unknown conflict policy %q", pulledImg.spec.Conflict)
+	}
 	// Create the directory if it doesn't exist
 	if _, err := os.Stat(pulledImg.spec.Dest); os.IsNotExist(err) {
 		_ = os.Mkdir(pulledImg.spec.Dest, 0755)
@@ -149,7 +400,11 @@ func (pulledImg *PulledImage) validateDest() error {
 	return nil
 }
 
-// extract config.json from image and write to image.Dest.
+// ImageConfigFile is the name of the image config written to Dest. The
+// runtime config, which runc expects in config.json, is generated from it.
+const ImageConfigFile = "image_config.json"
+
+// extract the image config from image and write to image.Dest.
 // assumes image.Dest is valid.
 func (pulledImg *PulledImage) writeConfig() error {
 	configFile, err := getConfig(pulledImg.img)
@@ -160,13 +415,8 @@ func (pulledImg *PulledImage) writeConfig() error {
 	if err != nil {
 		return err
 	}
-	configPath := filepath.Join(pulledImg.spec.Dest, "config.json")
-	jsonFile, err := os.Create(configPath)
-	if err != nil {
-		return err
-	}
-	_, err = jsonFile.Write(jdata)
-	return err
+	configPath := filepath.Join(pulledImg.spec.Dest, ImageConfigFile)
+	return ioutil.WriteFile(configPath, jdata, 0644)
 }
 
 // extract config.json from image and check for errors
@@ -0,0 +1,305 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// Inject is a local file, directory or tarball added to the rootfs after the
+// image's layers. Its entries are extracted like those of a layer, so their
+// ownership goes through the ID mappings, whiteouts are applied, and their
+// paths are resolved in the rootfs, through the image's symlinks.
+type Inject struct {
+	// Local file, directory or tarball, optionally gzipped
+	Source string
+	// Path in the rootfs to put a file, or a directory's content, at. When
+	// empty, Source must be a directory or a tarball, and is applied as an
+	// extra top layer.
+	Dest string
+	// Octal mode of a file, e.g. "0644", the source's by default
+	Mode string
+	// Owner in the image of a file or a directory's entries, root by
+	// default. A tarball's entries keep their own.
+	Uid int
+	Gid int
+}
+
+// inject applies Spec.Inject to the rootfs at rootfsPath
+func (pulledImg *PulledImage) inject(rootfsPath string, o owner, dirs map[string]dirMeta, s *contentStore) error {
+	for _, inj := range pulledImg.spec.Inject {
+		log.Infof("Injecting %s", inj.Source)
+		err := inj.makeParents(rootfsPath, o, dirs)
+		if err == nil {
+			err = inj.apply(func(tr *tar.Reader) error {
+				return handleFiles(tr, rootfsPath, o, dirs, nil, s, nil)
+			})
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "injecting %s", inj.Source)
+		}
+	}
+	return nil
+}
+
+// injectedPaths lists the paths of the rootfs at rootfsPath which Spec.Inject
+// adds, or whites out, parents first, resolved through the image's symlinks
+// like the injected entries were
+func (pulledImg *PulledImage) injectedPaths(rootfsPath string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(name string) error {
+		resolved, err := securePath(rootfsPath, name)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfsPath, resolved)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && !seen[rel] {
+			seen[rel] = true
+			paths = append(paths, rel)
+		}
+		return nil
+	}
+	for _, inj := range pulledImg.spec.Inject {
+		var parents []string
+		dest := strings.TrimPrefix(path.Clean("/"+inj.Dest), "/")
+		for dir := path.Dir(dest); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if err := add(dir); err != nil {
+				return nil, err
+			}
+		}
+		err := inj.apply(func(tr *tar.Reader) error {
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if isWhiteoutMeta(hdr.Name) {
+					continue
+				}
+				if err := add(hdr.Name); err != nil {
+					return err
+				}
+			}
+		})
+		if err != nil {
+			return nil, errors.WithMessagef(err, "listing %s", inj.Source)
+		}
+	}
+	return paths, nil
+}
+
+// validateInject checks Spec.Inject before anything is extracted
+func (pulledImg *PulledImage) validateInject() error {
+	for _, inj := range pulledImg.spec.Inject {
+		fi, err := os.Stat(inj.Source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if inj.Mode != "" {
+			if _, err := strconv.ParseUint(inj.Mode, 8, 32); err != nil {
+				return errors.Errorf("invalid mode %q to inject %s with", inj.Mode, inj.Source)
+			}
+			if fi.IsDir() {
+				return errors.Errorf("can't inject directory %s with a mode", inj.Source)
+			}
+		}
+		if dest := path.Clean(inj.Dest); dest == ".." || strings.HasPrefix(dest, "../") {
+			return errors.Errorf("can't inject %s to %s, outside of the rootfs", inj.Source, inj.Dest)
+		}
+		if inj.Dest == "" && !fi.IsDir() && !isTarball(inj.Source) {
+			return errors.Errorf("specify where to inject %s, only directories and tarballs are injected as layers", inj.Source)
+		}
+	}
+	return nil
+}
+
+// makeParents creates the missing parent directories of Dest in the rootfs at
+// rootfsPath like those of a layer, owned by root with mode 0755 and the
+// source's modification time
+func (inj Inject) makeParents(rootfsPath string, o owner, dirs map[string]dirMeta) error {
+	fi, err := os.Stat(inj.Source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var parents []string
+	dest := strings.TrimPrefix(path.Clean("/"+inj.Dest), "/")
+	for dir := path.Dir(dest); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+	for _, dir := range parents {
+		dirPath, err := securePath(rootfsPath, dir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(dirPath); err == nil {
+			continue
+		}
+		hdr := &tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: fi.ModTime()}
+		if err := extractFile(rootfsPath, hdr, nil, o, dirs, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply hands the entries of the injection, as a layer, to apply
+func (inj Inject) apply(apply func(*tar.Reader) error) error {
+	fi, err := os.Stat(inj.Source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if inj.Dest == "" && !fi.IsDir() {
+		f, err := os.Open(inj.Source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()
+		r, err := maybeGunzip(f)
+		if err != nil {
+			return err
+		}
+		return apply(tar.NewReader(r))
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := inj.write(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err = apply(tar.NewReader(pr))
+	// Stop the writer if apply failed early
+	pr.Close()
+	if writeErr := <-done; err == nil && writeErr != io.ErrClosedPipe {
+		err = writeErr
+	}
+	return err
+}
+
+// layer is the injection as a layer, for images carrying it
+func (inj Inject) layer() (v1.Layer, error) {
+	fi, err := os.Stat(inj.Source)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if inj.Dest == "" && !fi.IsDir() {
+		layer, err := tarball.LayerFromFile(inj.Source)
+		return layer, errors.WithStack(err)
+	}
+	// The tar is written again whenever the layer is read, the same way
+	// each time as long as the source doesn't change
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(inj.write(pw))
+		}()
+		return pr, nil
+	})
+	return layer, errors.WithStack(err)
+}
+
+// write the entries of an injected file or directory as a tar
+func (inj Inject) write(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	dest := strings.TrimPrefix(path.Clean("/"+inj.Dest), "/")
+	err := filepath.Walk(inj.Source, func(source string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(inj.Source, source)
+		if err != nil {
+			return err
+		}
+		name := path.Join(dest, filepath.ToSlash(rel))
+		// The rootfs itself keeps its metadata
+		if name == "." {
+			return nil
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(source); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return errors.Wrapf(err, "injecting %s", source)
+		}
+		hdr.Name = name
+		hdr.Uid, hdr.Gid = inj.Uid, inj.Gid
+		hdr.Uname, hdr.Gname = "", ""
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if inj.Mode != "" {
+			mode, _ := strconv.ParseUint(inj.Mode, 8, 32)
+			hdr.Mode = int64(mode)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.WithStack(err)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(tw.Close())
+}
+
+// isTarball reports whether the file at path is a tar, possibly gzipped
+func isTarball(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	r, err := maybeGunzip(f)
+	if err != nil {
+		return false
+	}
+	_, err = tar.NewReader(r).Next()
+	return err == nil
+}
+
+// maybeGunzip decompresses r if it is gzipped
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		return gz, errors.WithStack(err)
+	}
+	return br, nil
+}
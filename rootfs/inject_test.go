@@ -0,0 +1,154 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "dest")
+	require.NoError(t, os.Mkdir(dest, 0755))
+
+	layer := testLayer(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/resolv.conf", Typeflag: tar.TypeSymlink, Linkname: "../run/resolv.conf"},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "opt/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "opt/old", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/motd": "hello", "opt/old": "old"})
+
+	// A file, a directory with a whiteout, and a tarball
+	resolv := filepath.Join(dir, "resolv.conf")
+	require.NoError(t, ioutil.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0600))
+	overlay := filepath.Join(dir, "overlay")
+	require.NoError(t, os.MkdirAll(filepath.Join(overlay, "app"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(overlay, "app", "config"), []byte("config"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(overlay, ".wh.old"), nil, 0644))
+	tarball := filepath.Join(dir, "extra.tar")
+	require.NoError(t, ioutil.WriteFile(tarball, tarBytes(t, []*tar.Header{
+		{Name: "etc/.wh.motd", Typeflag: tar.TypeReg},
+		{Name: "etc/issue", Typeflag: tar.TypeReg, Mode: 0644, Uid: 2000, Gid: 2000},
+	}, map[string]string{"etc/issue": "issue"}), 0644))
+
+	pulledImg := testPulledImage(t, testImage(t, layer), Spec{
+		Dest: dest,
+		Inject: []Inject{
+			{Source: resolv, Dest: "/etc/resolv.conf", Mode: "0644", Uid: 1000, Gid: 1000},
+			{Source: overlay, Dest: "/opt"},
+			{Source: tarball},
+		},
+	})
+	require.NoError(t, pulledImg.validateInject())
+	require.NoError(t, pulledImg.extractRootfs([]v1.Layer{layer}))
+	rootfs := filepath.Join(dest, "rootfs")
+
+	// The injected file replaces the symlink rather than following it
+	fi, err := os.Lstat(filepath.Join(rootfs, "etc", "resolv.conf"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode())
+	if os.Geteuid() == 0 {
+		st := fi.Sys().(*syscall.Stat_t)
+		require.Equal(t, uint32(1000), st.Uid)
+		require.Equal(t, uint32(1000), st.Gid)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, "etc", "resolv.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.0.1\n", string(data))
+
+	data, err = ioutil.ReadFile(filepath.Join(rootfs, "opt", "app", "config"))
+	require.NoError(t, err)
+	require.Equal(t, "config", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(rootfs, "etc", "issue"))
+	require.NoError(t, err)
+	require.Equal(t, "issue", string(data))
+	for _, name := range []string{"opt/old", "opt/.wh.old", "etc/motd", "etc/.wh.motd"} {
+		_, err = os.Lstat(filepath.Join(rootfs, name))
+		require.True(t, os.IsNotExist(err), name)
+	}
+
+	// Files need to be told where to go, in the rootfs
+	pulledImg.spec.Inject = []Inject{{Source: resolv}}
+	require.Error(t, pulledImg.validateInject())
+	pulledImg.spec.Inject = []Inject{{Source: overlay, Mode: "0755"}}
+	require.Error(t, pulledImg.validateInject())
+	pulledImg.spec.Inject = []Inject{{Source: resolv, Dest: "../resolv.conf"}}
+	require.Error(t, pulledImg.validateInject())
+}
+
+// Test that injecting through the image's symlinks stays in the rootfs
+func TestInjectEscapes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	host := filepath.Join(dir, "host")
+	require.NoError(t, os.Mkdir(host, 0755))
+	dest := filepath.Join(dir, "dest")
+	require.NoError(t, os.Mkdir(dest, 0755))
+
+	// The image points etc at the host's
+	layer := testLayer(t, []*tar.Header{
+		{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+	}, nil)
+	resolv := filepath.Join(dir, "resolv.conf")
+	require.NoError(t, ioutil.WriteFile(resolv, []byte("nameserver 10.0.0.1\n"), 0644))
+	tarball := filepath.Join(dir, "evil.tar")
+	require.NoError(t, ioutil.WriteFile(tarball, tarBytes(t, []*tar.Header{
+		{Name: "../host/evil", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"../host/evil": "evil"}), 0644))
+
+	pulledImg := testPulledImage(t, testImage(t, layer), Spec{
+		Dest:   dest,
+		Inject: []Inject{{Source: resolv, Dest: "/etc/resolv.conf"}},
+	})
+	require.NoError(t, pulledImg.extractRootfs([]v1.Layer{layer}))
+	data, err := ioutil.ReadFile(filepath.Join(dest, "rootfs", host, "resolv.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.0.1\n", string(data))
+
+	pulledImg.spec.Inject = []Inject{{Source: tarball}}
+	require.Error(t, pulledImg.extractRootfs([]v1.Layer{layer}))
+
+	entries, err := ioutil.ReadDir(host)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+// Test that the missing parents of an injected file are created like the
+// directories of a layer
+func TestInjectParents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0700))
+	motd := filepath.Join(dir, "motd")
+	require.NoError(t, ioutil.WriteFile(motd, []byte("hello"), 0644))
+
+	inj := Inject{Source: motd, Dest: "/etc/motd.d/banner/motd"}
+	o := owner{uids: idMap{{ContainerID: 0, HostID: 100000, Size: 65536}}, gids: idMap{{ContainerID: 0, HostID: 200000, Size: 65536}}}
+	dirs := make(map[string]dirMeta)
+	require.NoError(t, inj.makeParents(rootfs, o, dirs))
+
+	// Existing directories are left alone
+	require.Len(t, dirs, 2)
+	for _, name := range []string{"etc/motd.d", "etc/motd.d/banner"} {
+		meta, ok := dirs[filepath.Join(rootfs, name)]
+		require.True(t, ok, name)
+		require.Equal(t, 100000, meta.uid)
+		require.Equal(t, 200000, meta.gid)
+		require.Equal(t, os.FileMode(0755)|os.ModeDir, meta.mode)
+	}
+	fi, err := os.Stat(filepath.Join(rootfs, "etc"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
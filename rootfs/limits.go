@@ -0,0 +1,164 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Limits bound what the layers of an untrusted image can make extraction do.
+// Zero means no limit.
+type Limits struct {
+	// Total size of the files of all layers
+	TotalBytes int64
+	// Size of a single file
+	FileBytes int64
+	// Number of entries of all layers, whiteouts and directories included
+	Entries int64
+	// Number of components of an entry's path
+	PathDepth int64
+	// Length of an entry's path or link target
+	PathLength int64
+	// Uncompressed bytes per compressed byte of a layer. Only checked once
+	// a layer has more than minRatioBytes uncompressed, as small layers can
+	// compress extremely well.
+	CompressionRatio int64
+}
+
+// minRatioBytes is how much of a layer is decompressed before the
+// compression ratio is checked
+const minRatioBytes = 1 << 20
+
+// maxTrailingBytes is how much a layer may have after the end of its tar,
+// which is only padding, whatever the Limits
+const maxTrailingBytes = 1 << 20
+
+// LimitError is the error when extraction is aborted because a layer went
+// over one of the Limits. It may be wrapped, use errors.Cause to get it.
+type LimitError struct {
+	// Name of the field of Limits
+	Limit string
+	// The value which went over the limit, and the limit. For
+	// CompressionRatio, these are the uncompressed bytes so far and the
+	// most allowed for the compressed bytes so far.
+	Value int64
+	Max   int64
+	// Digest of the layer, and the entry at fault, empty for the ratio of a
+	// layer which wasn't read up to its first entry
+	Layer string
+	Entry string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("layer %s, entry %q: %s is %d, over the limit of %d", e.Layer, e.Entry, e.Limit, e.Value, e.Max)
+}
+
+// limiter enforces Limits across the layers of an extraction. A nil limiter
+// enforces none.
+type limiter struct {
+	limits     Limits
+	totalBytes int64
+	entries    int64
+	// The layer being read, and its current entry
+	layer      string
+	entry      string
+	compressed int64
+	read       int64
+}
+
+// newLimiter returns a limiter for limits, nil if there are none
+func newLimiter(limits Limits) *limiter {
+	if limits == (Limits{}) {
+		return nil
+	}
+	return &limiter{limits: limits}
+}
+
+func (l *limiter) fail(limit string, value int64, max int64) error {
+	return &LimitError{Limit: limit, Value: value, Max: max, Layer: l.layer, Entry: l.entry}
+}
+
+// startLayer wraps the compressed stream of a layer and returns the reader to
+// decompress, and wrap, next
+func (l *limiter) startLayer(digest string, compressed io.Reader) io.Reader {
+	if l == nil {
+		return compressed
+	}
+	l.layer, l.entry = digest, ""
+	l.compressed, l.read = 0, 0
+	return &countingReader{r: compressed, n: &l.compressed}
+}
+
+// uncompressed wraps the uncompressed stream of the layer, to check the
+// compression ratio as it is read
+func (l *limiter) uncompressed(r io.Reader) io.Reader {
+	if l == nil || l.limits.CompressionRatio == 0 {
+		return r
+	}
+	return &ratioReader{r: r, l: l}
+}
+
+// check enforces the limits on a single entry, before it is extracted
+func (l *limiter) check(hdr *tar.Header) error {
+	if l == nil {
+		return nil
+	}
+	l.entry = hdr.Name
+	limits := l.limits
+
+	l.entries++
+	if limits.Entries > 0 && l.entries > limits.Entries {
+		return l.fail("Entries", l.entries, limits.Entries)
+	}
+	for _, name := range []string{hdr.Name, hdr.Linkname} {
+		if limits.PathLength > 0 && int64(len(name)) > limits.PathLength {
+			return l.fail("PathLength", int64(len(name)), limits.PathLength)
+		}
+	}
+	if limits.PathDepth > 0 {
+		depth := int64(len(strings.Split(strings.Trim(filepath.Clean("/"+hdr.Name), "/"), "/")))
+		if depth > limits.PathDepth {
+			return l.fail("PathDepth", depth, limits.PathDepth)
+		}
+	}
+	size := entrySize(hdr)
+	if limits.FileBytes > 0 && size > limits.FileBytes {
+		return l.fail("FileBytes", size, limits.FileBytes)
+	}
+	l.totalBytes += size
+	if limits.TotalBytes > 0 && l.totalBytes > limits.TotalBytes {
+		return l.fail("TotalBytes", l.totalBytes, limits.TotalBytes)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it in n
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// ratioReader fails once more has been decompressed than the compression
+// ratio allows
+type ratioReader struct {
+	r io.Reader
+	l *limiter
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	l := r.l
+	l.read += int64(n)
+	if max := l.compressed * l.limits.CompressionRatio; l.read > minRatioBytes && l.read > max {
+		return n, l.fail("CompressionRatio", l.read, max)
+	}
+	return n, err
+}
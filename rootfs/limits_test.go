@@ -0,0 +1,87 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	hdrs := []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/big", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/lib/small", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/lib/link", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib/small"},
+	}
+	contents := map[string]string{"usr/lib/big": strings.Repeat("x", 100), "usr/lib/small": "x"}
+
+	for _, test := range []struct {
+		limits Limits
+		// The error, if any
+		limit string
+		entry string
+		value int64
+	}{
+		{limits: Limits{Entries: 5, TotalBytes: 101, FileBytes: 100, PathDepth: 3, PathLength: 14}},
+		{limits: Limits{Entries: 4}, limit: "Entries", entry: "usr/lib/link", value: 5},
+		{limits: Limits{TotalBytes: 100}, limit: "TotalBytes", entry: "usr/lib/small", value: 101},
+		{limits: Limits{FileBytes: 99}, limit: "FileBytes", entry: "usr/lib/big", value: 100},
+		{limits: Limits{PathDepth: 2}, limit: "PathDepth", entry: "usr/lib/big", value: 3},
+		// The link target is the longest
+		{limits: Limits{PathLength: 13}, limit: "PathLength", entry: "usr/lib/link", value: 14},
+	} {
+		rootfs, err := ioutil.TempDir("", "rootfs")
+		require.NoError(t, err)
+		defer os.RemoveAll(rootfs)
+
+		err = handleFiles(buildTar(t, hdrs, contents), rootfs, testOwner(), make(map[string]dirMeta), nil, nil, newLimiter(test.limits))
+		if test.limit == "" {
+			require.NoError(t, err)
+			continue
+		}
+		limitErr, ok := err.(*LimitError)
+		require.True(t, ok, "%v", err)
+		require.Equal(t, test.limit, limitErr.Limit)
+		require.Equal(t, test.entry, limitErr.Entry)
+		require.Equal(t, test.value, limitErr.Value)
+	}
+	require.Nil(t, newLimiter(Limits{}))
+}
+
+func TestCompressionRatioLimit(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	// Zeros compress about a thousand times
+	bomb := testLayer(t, []*tar.Header{
+		{Name: "zeros", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"zeros": strings.Repeat("\x00", 8<<20)})
+	digest, err := bomb.Digest()
+	require.NoError(t, err)
+	pulledImg := testPulledImage(t, testImage(t, bomb), Spec{
+		Dest:   dest,
+		Limits: Limits{CompressionRatio: 100},
+	})
+	err = pulledImg.extractRootfs([]v1.Layer{bomb})
+	require.Error(t, err)
+	limitErr, ok := errors.Cause(err).(*LimitError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, "CompressionRatio", limitErr.Limit)
+	require.Equal(t, digest.String(), limitErr.Layer)
+	require.Equal(t, "zeros", limitErr.Entry)
+	_, err = os.Stat(filepath.Join(dest, "rootfs"))
+	require.True(t, os.IsNotExist(err))
+
+	// Ordinary layers are fine
+	pulledImg.spec.Limits.CompressionRatio = 2000
+	require.NoError(t, pulledImg.extractRootfs([]v1.Layer{bomb}))
+}
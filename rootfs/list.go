@@ -0,0 +1,225 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// listEntry is a path of the flattened tree, as computed from the layers'
+// tar headers
+type listEntry struct {
+	hdr *tar.Header
+	// Digest of the layer the entry comes from
+	layer string
+	// Created for its children, the image has no entry for it
+	implicit bool
+}
+
+// listTree is the flattened tree of an image
+type listTree struct {
+	// Keyed by absolute path
+	entries map[string]*listEntry
+	// Names of the entries of each directory, so that removing a path
+	// doesn't scan the whole tree
+	children map[string]map[string]bool
+}
+
+func newListTree() *listTree {
+	return &listTree{
+		entries:  make(map[string]*listEntry),
+		children: make(map[string]map[string]bool),
+	}
+}
+
+// List prints the tree Extract would produce, with the metadata of every
+// path and the layer it comes from, without writing anything to disk
+func (pulledImg *PulledImage) List(w io.Writer) error {
+	layers, err := pulledImg.layers()
+	if err != nil {
+		return err
+	}
+	f, err := newFilter(pulledImg.spec.Include, pulledImg.spec.Exclude)
+	if err != nil {
+		return err
+	}
+	tree := newListTree()
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = extractLayer(layer, nil, func(tr *tar.Reader) error {
+			return tree.addLayer(tr, digest, f)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tree.write(w)
+}
+
+// addLayer applies the entries of a layer to the tree, with the same
+// semantics as handleFiles
+func (tree *listTree) addLayer(tr *tar.Reader, digest v1.Hash, f *filter) error {
+	added := make(map[string]bool)
+	// Directory entries which were filtered out, in case they are the
+	// parents of included entries
+	skipped := make(map[string]*tar.Header)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isWhiteoutMeta(hdr.Name) {
+			continue
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		base := path.Base(name)
+		dir := path.Dir(name)
+		if base == whiteoutOpaqueDir {
+			tree.removeLower(dir, added)
+			continue
+		}
+		if isWhiteout(base) {
+			target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if target != dir && !added[target] {
+				tree.remove(target)
+			}
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink && f.includes(hdr.Name) && !f.includes(hdr.Linkname) {
+			tree.remove(name)
+		}
+		if !f.includes(hdr.Name) || (hdr.Typeflag == tar.TypeLink && !f.includes(hdr.Linkname)) {
+			if hdr.Typeflag == tar.TypeDir {
+				skipped[name] = hdr
+				if entry, ok := tree.entries[name]; ok && entry.hdr.Typeflag == tar.TypeDir {
+					entry.hdr, entry.layer, entry.implicit = hdr, digest.String(), false
+				}
+			}
+			continue
+		}
+
+		markAdded(added, name)
+		tree.addParents(dir, digest, skipped)
+		// Only a directory keeps what is under the path
+		existing, ok := tree.entries[name]
+		if ok && (hdr.Typeflag != tar.TypeDir || existing.hdr.Typeflag != tar.TypeDir) {
+			tree.remove(name)
+		}
+		tree.set(name, &listEntry{hdr: hdr, layer: digest.String()})
+	}
+}
+
+// addParents creates the missing parents of an entry, like extractFile does
+func (tree *listTree) addParents(dir string, digest v1.Hash, skipped map[string]*tar.Header) {
+	for ; dir != "/"; dir = path.Dir(dir) {
+		if entry, ok := tree.entries[dir]; ok && entry.hdr.Typeflag == tar.TypeDir {
+			return
+		}
+		tree.remove(dir)
+		if hdr, ok := skipped[dir]; ok {
+			tree.set(dir, &listEntry{hdr: hdr, layer: digest.String()})
+			continue
+		}
+		hdr := &tar.Header{
+			Name:     dir,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		}
+		tree.set(dir, &listEntry{hdr: hdr, layer: digest.String(), implicit: true})
+	}
+}
+
+// set adds or replaces the entry at name
+func (tree *listTree) set(name string, entry *listEntry) {
+	tree.entries[name] = entry
+	dir := path.Dir(name)
+	if tree.children[dir] == nil {
+		tree.children[dir] = make(map[string]bool)
+	}
+	tree.children[dir][path.Base(name)] = true
+}
+
+// remove removes name and everything under it
+func (tree *listTree) remove(name string) {
+	if _, ok := tree.entries[name]; !ok {
+		return
+	}
+	for child := range tree.children[name] {
+		tree.remove(path.Join(name, child))
+	}
+	delete(tree.entries, name)
+	delete(tree.children, name)
+	delete(tree.children[path.Dir(name)], path.Base(name))
+}
+
+// removeLower removes everything under dir which wasn't added by the current
+// layer, like the filesystem's removeLower
+func (tree *listTree) removeLower(dir string, added map[string]bool) {
+	for child := range tree.children[dir] {
+		p := path.Join(dir, child)
+		if !added[p] {
+			// Anything under an entry of a lower layer goes with it
+			tree.remove(p)
+			continue
+		}
+		tree.removeLower(p, added)
+	}
+}
+
+// write prints the tree, sorted by path, followed by totals
+func (tree *listTree) write(w io.Writer) error {
+	paths := make([]string, 0, len(tree.entries))
+	for p := range tree.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var size int64
+	for _, p := range paths {
+		entry := tree.entries[p]
+		hdr := entry.hdr
+		size += entrySize(hdr)
+		line := fmt.Sprintf("%s %d/%d %9d %s %s %s",
+			hdr.FileInfo().Mode(), hdr.Uid, hdr.Gid, entrySize(hdr),
+			hdr.ModTime.UTC().Format("2006-01-02T15:04:05Z"), shortDigest(entry.layer), p)
+		switch {
+		case hdr.Typeflag == tar.TypeSymlink:
+			line += " -> " + hdr.Linkname
+		case hdr.Typeflag == tar.TypeLink:
+			line += " link to " + path.Clean("/"+hdr.Linkname)
+		case entry.implicit:
+			line += " (implicit)"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d entries, %d bytes\n", len(paths), size)
+	return errors.WithStack(err)
+}
+
+// shortDigest abbreviates a digest to 12 hex characters, as docker does
+func shortDigest(digest string) string {
+	if i := strings.Index(digest, ":"); i >= 0 && len(digest) > i+13 {
+		return digest[:i+13]
+	}
+	return digest
+}
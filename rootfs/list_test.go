@@ -0,0 +1,102 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test that the listing matches what is extracted, and shows which layer
+// each entry comes from
+func TestList(t *testing.T) {
+	mtime := time.Date(2019, 8, 20, 20, 19, 30, 0, time.UTC)
+	lower := testLayer(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "etc/group", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "opaque/old", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "gone/sub/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "replaced/child", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	}, map[string]string{"etc/passwd": "root", "etc/group": "root"})
+	upper := testLayer(t, []*tar.Header{
+		{Name: "etc/.wh.group", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "opaque/new", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: ".wh.gone", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "replaced", Typeflag: tar.TypeSymlink, Linkname: "etc", ModTime: mtime},
+		{Name: "etc/hostname", Typeflag: tar.TypeLink, Linkname: "etc/passwd", ModTime: mtime},
+	}, nil)
+	lowerDigest, err := lower.Digest()
+	require.NoError(t, err)
+	upperDigest, err := upper.Digest()
+	require.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	pulledImg := testPulledImage(t, testImage(t, lower, upper), Spec{Dest: dest})
+
+	var buf bytes.Buffer
+	require.NoError(t, pulledImg.List(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, "6 entries, 4 bytes", lines[len(lines)-1])
+	lines = lines[:len(lines)-1]
+
+	// Nothing is written
+	entries, err := ioutil.ReadDir(dest)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.Equal(t, "-rw-r--r-- 0/0         4 2019-08-20T20:19:30Z "+shortDigest(lowerDigest.String())+" /etc/passwd", lines[2])
+	require.Contains(t, lines[0], shortDigest(lowerDigest.String())+" /etc")
+	require.True(t, strings.HasSuffix(lines[1], shortDigest(upperDigest.String())+" /etc/hostname link to /etc/passwd"), lines[1])
+	require.True(t, strings.HasSuffix(lines[5], " /replaced -> etc"), lines[5])
+
+	// Same paths as the extracted rootfs
+	rootfs := filepath.Join(dest, "rootfs")
+	require.NoError(t, os.Mkdir(rootfs, 0755))
+	layers, err := pulledImg.img.Layers()
+	require.NoError(t, err)
+	require.NoError(t, pulledImg.flatten(layers, rootfs))
+	var extracted []string
+	err = filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == rootfs {
+			return err
+		}
+		extracted = append(extracted, strings.TrimPrefix(path, rootfs))
+		return nil
+	})
+	require.NoError(t, err)
+	var listed []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		listed = append(listed, fields[5])
+	}
+	require.Equal(t, extracted, listed)
+}
+
+// Test that removing a path only removes what is under it, through the
+// index of the directories' children
+func TestListTreeRemove(t *testing.T) {
+	tree := newListTree()
+	for _, name := range []string{"/etc", "/etc/ssl", "/etc/ssl/certs", "/etc2", "/etc2/file"} {
+		tree.set(name, &listEntry{hdr: &tar.Header{Name: name, Typeflag: tar.TypeDir}})
+	}
+	tree.remove("/etc")
+	require.Len(t, tree.entries, 2)
+	require.Contains(t, tree.entries, "/etc2/file")
+	require.Equal(t, map[string]bool{"etc2": true}, tree.children["/"])
+	require.NotContains(t, tree.children, "/etc/ssl")
+
+	tree.removeLower("/", map[string]bool{"/etc2": true})
+	require.Len(t, tree.entries, 1)
+	require.Contains(t, tree.entries, "/etc2")
+}
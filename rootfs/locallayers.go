@@ -0,0 +1,44 @@
+package rootfs
+
+import (
+	"os"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// layers are the image's layers followed by Spec.ExtraLayers
+func (pulledImg *PulledImage) layers() ([]v1.Layer, error) {
+	layers, err := pulledImg.img.Layers()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, source := range pulledImg.spec.ExtraLayers {
+		layer, err := localLayer(source)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		log.Infof("Adding layer %s from %s", digest, source)
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// localLayer is the layer of a local tarball, optionally gzipped, or of a
+// directory, whose entries are owned by root
+func localLayer(source string) (v1.Layer, error) {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !fi.IsDir() && !isTarball(source) {
+		return nil, errors.Errorf("layer %s is neither a directory nor a tarball", source)
+	}
+	layer, err := Inject{Source: source}.layer()
+	return layer, errors.Wrapf(err, "reading layer %s", source)
+}
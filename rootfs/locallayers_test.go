@@ -0,0 +1,77 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtraLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "dest")
+	require.NoError(t, os.Mkdir(dest, 0755))
+
+	layer := testLayer(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/issue", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/motd": "hello", "etc/issue": "issue"})
+
+	// A directory removing a file, then a gzipped tarball replacing one
+	fixtures := filepath.Join(dir, "fixtures")
+	require.NoError(t, os.MkdirAll(filepath.Join(fixtures, "etc"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(fixtures, "etc", ".wh.issue"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(fixtures, "etc", "fixture"), []byte("fixture"), 0644))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err = zw.Write(tarBytes(t, []*tar.Header{
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/motd": "patched"}))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	patch := filepath.Join(dir, "patch.tar.gz")
+	require.NoError(t, ioutil.WriteFile(patch, gz.Bytes(), 0644))
+
+	pulledImg := testPulledImage(t, testImage(t, layer), Spec{
+		Dest:        dest,
+		ExtraLayers: []string{fixtures, patch},
+	})
+	layers, err := pulledImg.layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+	require.NoError(t, pulledImg.extractRootfs(layers))
+
+	rootfs := filepath.Join(dest, "rootfs")
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, "etc", "motd"))
+	require.NoError(t, err)
+	require.Equal(t, "patched", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(rootfs, "etc", "fixture"))
+	require.NoError(t, err)
+	require.Equal(t, "fixture", string(data))
+	_, err = os.Lstat(filepath.Join(rootfs, "etc", "issue"))
+	require.True(t, os.IsNotExist(err))
+
+	// The local layers are recorded, and the same the next time
+	record, err := readProvenance(dest)
+	require.NoError(t, err)
+	require.Len(t, record.Layers, 3)
+	again, err := pulledImg.layers()
+	require.NoError(t, err)
+	for i, layer := range again {
+		digest, err := layer.Digest()
+		require.NoError(t, err)
+		require.Equal(t, record.Layers[i].Digest, digest.String())
+	}
+
+	pulledImg.spec.ExtraLayers = []string{filepath.Join(fixtures, "etc", "fixture")}
+	_, err = pulledImg.layers()
+	require.Error(t, err)
+}
@@ -0,0 +1,362 @@
+package rootfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestFile is the name of the manifest of Dest/rootfs, written to Dest
+// when Spec.Manifest is set
+const ManifestFile = "rootfs.mtree"
+
+// manifestHeader starts every manifest
+const manifestHeader = "#mtree v2.0"
+
+// Kinds of Drift
+const (
+	// DriftModified is a path whose type, content, mode, link target,
+	// timestamp or xattrs changed
+	DriftModified = "modified"
+	// DriftAdded is a path which isn't in the manifest
+	DriftAdded = "added"
+	// DriftMissing is a path of the manifest which doesn't exist
+	DriftMissing = "missing"
+	// DriftOwner is a path whose uid or gid changed
+	DriftOwner = "wrong owner"
+)
+
+// Drift is a difference between a rootfs and its manifest
+type Drift struct {
+	Path string
+	Kind string
+	// Keywords which differ, for DriftModified and DriftOwner
+	Keywords []string
+}
+
+func (d Drift) String() string {
+	if len(d.Keywords) == 0 {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Path)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.Kind, d.Path, strings.Join(d.Keywords, ", "))
+}
+
+// manifestEntry is a path of the manifest, with mtree style keywords
+type manifestEntry struct {
+	path     string
+	keywords map[string]string
+}
+
+// writeManifest writes the manifest of the tree at root to w
+func writeManifest(w io.Writer, root string) error {
+	entries, err := manifestEntries(root)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, manifestHeader)
+	for _, entry := range entries {
+		keys := make([]string, 0, len(entry.keywords))
+		for key := range entry.keywords {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprint(bw, encodeManifestPath(entry.path))
+		for _, key := range keys {
+			fmt.Fprintf(bw, " %s=%s", key, entry.keywords[key])
+		}
+		fmt.Fprintln(bw)
+	}
+	return errors.WithStack(bw.Flush())
+}
+
+// readManifest parses a manifest written by writeManifest
+func readManifest(r io.Reader) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		// Blank lines, whitespace included
+		if len(fields) == 0 {
+			continue
+		}
+		path, err := decodeManifestPath(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		entry := manifestEntry{path: path, keywords: make(map[string]string)}
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid keyword %q for %s", field, path)
+			}
+			entry.keywords[parts[0]] = parts[1]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.WithStack(scanner.Err())
+}
+
+// manifestEntries describes every path of the tree at root, in lexical order
+func manifestEntries(root string) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	// The entries of each hard linked file. Only the links in the tree are
+	// counted, a file may also be linked from a store.
+	links := make(map[inode][]int)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		keywords, err := manifestKeywords(path, fi)
+		if err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			links[key] = append(links[key], len(entries))
+		}
+		entries = append(entries, manifestEntry{path: "./" + filepath.ToSlash(rel), keywords: keywords})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, linked := range links {
+		if len(linked) < 2 {
+			continue
+		}
+		for _, i := range linked {
+			entries[i].keywords["nlink"] = strconv.Itoa(len(linked))
+		}
+	}
+	// The root is "./.", make it "."
+	if len(entries) > 0 {
+		entries[0].path = "."
+	}
+	return entries, nil
+}
+
+// manifestKeywords describes a single file
+func manifestKeywords(path string, fi os.FileInfo) (map[string]string, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.Errorf("unsupported file info for %s", path)
+	}
+	keywords := map[string]string{
+		"mode": fmt.Sprintf("%#o", st.Mode&07777),
+		"uid":  strconv.Itoa(int(st.Uid)),
+		"gid":  strconv.Itoa(int(st.Gid)),
+		"time": fmt.Sprintf("%d.%09d", st.Mtim.Sec, st.Mtim.Nsec),
+	}
+
+	mode := fi.Mode()
+	switch {
+	case mode.IsRegular():
+		keywords["type"] = "file"
+		keywords["size"] = strconv.FormatInt(fi.Size(), 10)
+		digest, err := fileDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		keywords["sha256digest"] = digest
+	case mode.IsDir():
+		keywords["type"] = "dir"
+	case mode&os.ModeSymlink != 0:
+		keywords["type"] = "link"
+		link, err := os.Readlink(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keywords["link"] = encodeManifestPath(link)
+	case mode&os.ModeCharDevice != 0:
+		keywords["type"] = "char"
+		keywords["device"] = fmt.Sprintf("%d,%d", devMajor(st.Rdev), devMinor(st.Rdev))
+	case mode&os.ModeDevice != 0:
+		keywords["type"] = "block"
+		keywords["device"] = fmt.Sprintf("%d,%d", devMajor(st.Rdev), devMinor(st.Rdev))
+	case mode&os.ModeNamedPipe != 0:
+		keywords["type"] = "fifo"
+	case mode&os.ModeSocket != 0:
+		keywords["type"] = "socket"
+	}
+
+	names, err := llistxattr(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		value, err := lgetxattr(path, name)
+		if err != nil {
+			return nil, err
+		}
+		keywords["xattr."+name] = base64.StdEncoding.EncodeToString(value)
+	}
+	return keywords, nil
+}
+
+// fileDigest is the sha256 of a file's content
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "hashing %s", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func devMajor(dev uint64) uint64 {
+	return (dev>>8)&0xfff | (dev>>32)&^0xfff
+}
+
+func devMinor(dev uint64) uint64 {
+	return dev&0xff | (dev>>12)&^0xff
+}
+
+// encodeManifestPath escapes whitespace, non-printable characters and
+// backslashes as \ooo octal, like vis(3) does for mtree
+func encodeManifestPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c <= ' ' || c > '~' || c == '\\' || c == '#' || c == '=' {
+			fmt.Fprintf(&b, "\\%03o", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// decodeManifestPath reverses encodeManifestPath
+func decodeManifestPath(path string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] != '\\' {
+			b.WriteByte(path[i])
+			continue
+		}
+		if i+3 >= len(path) {
+			return "", errors.Errorf("invalid escape in %q", path)
+		}
+		c, err := strconv.ParseUint(path[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", errors.Errorf("invalid escape in %q", path)
+		}
+		b.WriteByte(byte(c))
+		i += 3
+	}
+	return b.String(), nil
+}
+
+// VerifyManifest compares the rootfs at root against the manifest at
+// manifestPath, and returns how it drifted
+func VerifyManifest(manifestPath string, root string) ([]Drift, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	expected, err := readManifest(f)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := manifestEntries(root)
+	if err != nil {
+		return nil, err
+	}
+	return compareManifests(expected, actual), nil
+}
+
+// compareManifests lists the drift from expected to actual, in path order
+func compareManifests(expected []manifestEntry, actual []manifestEntry) []Drift {
+	actualByPath := make(map[string]manifestEntry, len(actual))
+	for _, entry := range actual {
+		actualByPath[entry.path] = entry
+	}
+
+	var drifts []Drift
+	for _, want := range expected {
+		got, ok := actualByPath[want.path]
+		if !ok {
+			drifts = append(drifts, Drift{Path: want.path, Kind: DriftMissing})
+			continue
+		}
+		delete(actualByPath, want.path)
+
+		var modified, owner []string
+		keys := make(map[string]bool)
+		for key := range want.keywords {
+			keys[key] = true
+		}
+		for key := range got.keywords {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			if want.keywords[key] == got.keywords[key] {
+				continue
+			}
+			if key == "uid" || key == "gid" {
+				owner = append(owner, key)
+			} else {
+				modified = append(modified, key)
+			}
+		}
+		if len(modified) > 0 {
+			drifts = append(drifts, Drift{Path: want.path, Kind: DriftModified, Keywords: modified})
+		}
+		if len(owner) > 0 {
+			drifts = append(drifts, Drift{Path: want.path, Kind: DriftOwner, Keywords: owner})
+		}
+	}
+	for _, entry := range actual {
+		if _, ok := actualByPath[entry.path]; ok {
+			drifts = append(drifts, Drift{Path: entry.path, Kind: DriftAdded})
+		}
+	}
+	sort.SliceStable(drifts, func(i, j int) bool {
+		return drifts[i].Path < drifts[j].Path
+	})
+	return drifts
+}
+
+// writeManifestFile writes the manifest of the tree at root to path
+func writeManifestFile(path string, root string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeManifest(f, root); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.WithStack(f.Close())
+}
@@ -0,0 +1,97 @@
+package rootfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestPathEscaping(t *testing.T) {
+	for _, path := range []string{"./plain", "./with space", "./tab\there", "./back\\slash", "./a=b#c", "./caf\xc3\xa9"} {
+		encoded := encodeManifestPath(path)
+		require.NotContains(t, encoded, " ")
+		require.NotContains(t, encoded, "\t")
+		decoded, err := decodeManifestPath(encoded)
+		require.NoError(t, err)
+		require.Equal(t, path, decoded)
+	}
+	_, err := decodeManifestPath("./bad\\9")
+	require.Error(t, err)
+}
+
+// Test that a manifest round-trips, and that every kind of drift is reported
+func TestVerifyManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "rootfs")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc", "my file"), []byte("spaces"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "gone"), []byte("gone"), 0644))
+	require.NoError(t, os.Symlink("etc/passwd", filepath.Join(root, "link")))
+
+	manifestPath := filepath.Join(dir, ManifestFile)
+	require.NoError(t, writeManifestFile(manifestPath, root))
+
+	var buf bytes.Buffer
+	require.NoError(t, writeManifest(&buf, root))
+	entries, err := readManifest(&buf)
+	require.NoError(t, err)
+	paths := []string{}
+	for _, entry := range entries {
+		paths = append(paths, entry.path)
+	}
+	require.Equal(t, []string{".", "./etc", "./etc/my file", "./etc/passwd", "./gone", "./link"}, paths)
+	require.Equal(t, "link", entries[5].keywords["type"])
+	require.Equal(t, "etc/passwd", entries[5].keywords["link"])
+	require.Equal(t, "0600", entries[2].keywords["mode"])
+
+	// Blank lines are skipped, even with whitespace
+	entries, err = readManifest(strings.NewReader("#mtree\n \t\n./etc type=dir\n\n"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	drifts, err := VerifyManifest(manifestPath, root)
+	require.NoError(t, err)
+	require.Empty(t, drifts)
+
+	// Tamper with the rootfs, keeping the directories' timestamps so that
+	// only the files show up
+	etc := filepath.Join(root, "etc")
+	fi, err := os.Stat(etc)
+	require.NoError(t, err)
+	rootFi, err := os.Stat(root)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(etc, "passwd"), []byte("evil:x:0:0::/:/bin/sh\n"), 0644))
+	later := fi.ModTime().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(etc, "passwd"), later, later))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(etc, "shadow"), []byte("evil"), 0600))
+	require.NoError(t, os.Remove(filepath.Join(root, "gone")))
+	require.NoError(t, os.Chmod(filepath.Join(etc, "my file"), 0644))
+	require.NoError(t, os.Chtimes(etc, fi.ModTime(), fi.ModTime()))
+	require.NoError(t, os.Chtimes(root, rootFi.ModTime(), rootFi.ModTime()))
+	if os.Geteuid() == 0 {
+		require.NoError(t, os.Lchown(filepath.Join(root, "link"), 1000, 1000))
+	}
+
+	drifts, err = VerifyManifest(manifestPath, root)
+	require.NoError(t, err)
+	expected := []Drift{
+		{Path: "./etc/my file", Kind: DriftModified, Keywords: []string{"mode"}},
+		{Path: "./etc/passwd", Kind: DriftModified, Keywords: []string{"sha256digest", "size", "time"}},
+		{Path: "./etc/shadow", Kind: DriftAdded},
+		{Path: "./gone", Kind: DriftMissing},
+	}
+	if os.Geteuid() == 0 {
+		expected = append(expected, Drift{Path: "./link", Kind: DriftOwner, Keywords: []string{"gid", "uid"}})
+	}
+	require.Equal(t, expected, drifts)
+}
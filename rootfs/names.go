@@ -0,0 +1,145 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/ForAllSecure/rootfs_builder/util"
+)
+
+// Names maps user and group names to the IDs they have in the image, for
+// Spec.OwnerByName
+type Names struct {
+	Users  map[string]int
+	Groups map[string]int
+}
+
+// nameResolver resolves the user and group names of tar headers to IDs, from
+// Names and then from the /etc/passwd and /etc/group of the rootfs as
+// extracted so far
+type nameResolver struct {
+	// Empty to only use the table
+	rootfs string
+	table  Names
+	// From the rootfs, nil until parsed
+	users  map[string]int
+	groups map[string]int
+	// Names which couldn't be resolved, their numeric IDs were kept
+	unresolvedUsers  map[string]bool
+	unresolvedGroups map[string]bool
+}
+
+func newNameResolver(rootfs string, table Names) *nameResolver {
+	return &nameResolver{
+		rootfs:           rootfs,
+		table:            table,
+		unresolvedUsers:  make(map[string]bool),
+		unresolvedGroups: make(map[string]bool),
+	}
+}
+
+// ids resolves the owner of hdr, falling back to its numeric IDs
+func (r *nameResolver) ids(hdr *tar.Header) (int, int) {
+	if r == nil {
+		return hdr.Uid, hdr.Gid
+	}
+	r.load()
+	uid := resolveName(hdr.Uname, hdr.Uid, r.table.Users, r.users, r.unresolvedUsers)
+	gid := resolveName(hdr.Gname, hdr.Gid, r.table.Groups, r.groups, r.unresolvedGroups)
+	return uid, gid
+}
+
+// resolveName looks name up in the table, then in the rootfs
+func resolveName(name string, id int, table map[string]int, rootfs map[string]int, unresolved map[string]bool) int {
+	if name == "" {
+		return id
+	}
+	if resolved, ok := table[name]; ok {
+		return resolved
+	}
+	if resolved, ok := rootfs[name]; ok {
+		return resolved
+	}
+	unresolved[name] = true
+	return id
+}
+
+// load parses the rootfs /etc/passwd and /etc/group, unless they already
+// are. The image's symlinks are followed in the rootfs.
+func (r *nameResolver) load() {
+	if r.rootfs == "" || r.users != nil {
+		return
+	}
+	r.users = make(map[string]int)
+	r.groups = make(map[string]int)
+	passwdPath, err := followPath(r.rootfs, "etc/passwd")
+	var users []util.User
+	if err == nil {
+		users, err = util.ParsePasswdFile(passwdPath)
+	}
+	if err != nil {
+		log.Warnf("Failed to read the image's /etc/passwd: %s", err)
+	}
+	for _, u := range users {
+		if _, ok := r.users[u.Name]; !ok {
+			r.users[u.Name] = u.Uid
+		}
+	}
+	groupPath, err := followPath(r.rootfs, "etc/group")
+	var groups []util.Group
+	if err == nil {
+		groups, err = util.ParseGroupFile(groupPath)
+	}
+	if err != nil {
+		log.Warnf("Failed to read the image's /etc/group: %s", err)
+	}
+	for _, g := range groups {
+		if _, ok := r.groups[g.Name]; !ok {
+			r.groups[g.Name] = g.Gid
+		}
+	}
+}
+
+// changed is called with each entry which was extracted or whited out, so
+// that /etc/passwd and /etc/group are parsed again when a layer changes them
+func (r *nameResolver) changed(name string) {
+	if r == nil {
+		return
+	}
+	name = filepath.Clean("/" + name)
+	base, dir := filepath.Base(name), filepath.Dir(name)
+	if base == whiteoutOpaqueDir {
+		name = dir
+	} else if isWhiteout(base) {
+		name = filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	}
+	switch name {
+	case "/", "/etc", "/etc/passwd", "/etc/group":
+		r.users, r.groups = nil, nil
+	}
+}
+
+// report warns about the names which couldn't be resolved
+func (r *nameResolver) report() {
+	if r == nil {
+		return
+	}
+	if len(r.unresolvedUsers) > 0 {
+		log.Warnf("Kept the numeric uids of unknown users: %s", sortedNames(r.unresolvedUsers))
+	}
+	if len(r.unresolvedGroups) > 0 {
+		log.Warnf("Kept the numeric gids of unknown groups: %s", sortedNames(r.unresolvedGroups))
+	}
+}
+
+func sortedNames(names map[string]bool) string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
@@ -0,0 +1,85 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test that ownership is resolved by name with the passwd and group files as
+// extracted so far, and with the table, which comes first
+func TestOwnerByName(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chowning to other users needs root")
+	}
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	names := newNameResolver(rootfs, Names{Groups: map[string]int{"staff": 50}})
+	o := owner{uids: offsetMap(0), gids: offsetMap(0), names: names}
+	dirs := make(map[string]dirMeta)
+
+	// The image was built on a host where app was 1000
+	lower := buildTar(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/group", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "app", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000, Uname: "app", Gname: "app"},
+		{Name: "staff", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000, Uname: "app", Gname: "staff"},
+		{Name: "ghost", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1234, Gid: 1234, Uname: "ghost", Gname: "ghost"},
+		{Name: "numeric", Typeflag: tar.TypeReg, Mode: 0644, Uid: 7, Gid: 7},
+	}, map[string]string{
+		"etc/passwd": "root:x:0:0::/root:/bin/sh\napp:x:999:998::/app:/bin/sh\n",
+		"etc/group":  "root:x:0:\napp:x:998:\nstaff:x:20:\n",
+	})
+	require.NoError(t, handleFiles(lower, rootfs, o, dirs, nil, nil, nil))
+
+	// A later layer changes app's uid
+	upper := buildTar(t, []*tar.Header{
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "later", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000, Uname: "app", Gname: "app"},
+	}, map[string]string{"etc/passwd": "root:x:0:0::/root:/bin/sh\napp:x:500:998::/app:/bin/sh\n"})
+	require.NoError(t, handleFiles(upper, rootfs, o, dirs, nil, nil, nil))
+
+	ids := func(name string) [2]int {
+		fi, err := os.Lstat(filepath.Join(rootfs, name))
+		require.NoError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return [2]int{int(st.Uid), int(st.Gid)}
+	}
+	require.Equal(t, [2]int{999, 998}, ids("app"))
+	require.Equal(t, [2]int{999, 50}, ids("staff"))
+	require.Equal(t, [2]int{1234, 1234}, ids("ghost"))
+	require.Equal(t, [2]int{7, 7}, ids("numeric"))
+	require.Equal(t, [2]int{500, 998}, ids("later"))
+
+	require.Equal(t, map[string]bool{"ghost": true}, names.unresolvedUsers)
+	require.Equal(t, map[string]bool{"ghost": true}, names.unresolvedGroups)
+}
+
+// Test that the image's symlinks to passwd and group files are followed in
+// the rootfs, never to the host's
+func TestOwnerByNameSymlinks(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+	host, err := ioutil.TempDir("", "host")
+	require.NoError(t, err)
+	defer os.RemoveAll(host)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(host, "passwd"), []byte("app:x:0:0::/:/bin/sh\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(host, "group"), []byte("app:x:0:\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, host), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, host, "passwd"), []byte("app:x:999:998::/app:/bin/sh\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, host, "group"), []byte("app:x:998:\n"), 0644))
+	require.NoError(t, os.Symlink(host, filepath.Join(rootfs, "etc")))
+
+	uid, gid := newNameResolver(rootfs, Names{}).ids(&tar.Header{Uid: 1000, Gid: 1000, Uname: "app", Gname: "app"})
+	require.Equal(t, 999, uid)
+	require.Equal(t, 998, gid)
+}
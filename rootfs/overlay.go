@@ -0,0 +1,253 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// Xattrs understood by overlayfs. The user namespace ones are used when
+// mounting with the userxattr option, as non-root users can't set trusted
+// xattrs, nor create the 0/0 character devices of whiteouts. Whiteouts are
+// then empty files with overlayUserWhiteoutXattr, in directories marked with
+// the "x" opaque value, supported since Linux 6.7.
+const (
+	overlayOpaqueXattr       = "trusted.overlay.opaque"
+	overlayUserOpaqueXattr   = "user.overlay.opaque"
+	overlayUserWhiteoutXattr = "user.overlay.whiteout"
+)
+
+// extractOverlay extracts each layer into its own directory under
+// Dest/layers, and writes the lowerdir option to mount them to Dest/lowerdir.
+// Layers which were already extracted with the same settings are reused.
+func (pulledImg *PulledImage) extractOverlay(layers []v1.Layer) error {
+	layersPath, err := filepath.Abs(filepath.Join(pulledImg.spec.Dest, "layers"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.MkdirAll(layersPath, 0755); err != nil {
+		return err
+	}
+
+	lowerdirs := make([]string, len(layers))
+	for i, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return err
+		}
+		// Use the hex only, overlayfs separates lower directories with ':'
+		layerPath := filepath.Join(layersPath, diffID.Hex)
+		// overlayfs expects the top layer first
+		lowerdirs[len(layers)-1-i] = layerPath
+
+		if pulledImg.overlayLayerCurrent(layerPath) {
+			log.Infof("Reusing layer %s", diffID)
+			continue
+		}
+		if _, err := os.Lstat(layerPath); err == nil {
+			log.Infof("Layer %s was extracted with other settings, extracting it again", diffID)
+		}
+		if err := pulledImg.extractOverlayLayer(layer, layerPath); err != nil {
+			return err
+		}
+	}
+
+	lowerdir := "lowerdir=" + strings.Join(lowerdirs, ":")
+	log.Info(lowerdir)
+	return ioutil.WriteFile(filepath.Join(pulledImg.spec.Dest, "lowerdir"), []byte(lowerdir+"\n"), 0644)
+}
+
+// overlaySettingsPath is where the settings a layer directory was extracted
+// with are recorded, next to it
+func overlaySettingsPath(layerPath string) string {
+	return layerPath + ".settings"
+}
+
+// overlayLayerCurrent reports whether the layer directory at layerPath was
+// extracted with the current settings
+func (pulledImg *PulledImage) overlayLayerCurrent(layerPath string) bool {
+	if _, err := os.Stat(layerPath); err != nil {
+		return false
+	}
+	settings, err := ioutil.ReadFile(overlaySettingsPath(layerPath))
+	return err == nil && string(settings) == pulledImg.settings()
+}
+
+// extractOverlayLayer extracts a single layer to layerPath, replacing what is
+// there, and records the settings it was extracted with. The layer is
+// extracted next to layerPath first, so that layerPath only ever holds a
+// complete layer.
+func (pulledImg *PulledImage) extractOverlayLayer(layer v1.Layer, layerPath string) error {
+	tmpPath := filepath.Join(filepath.Dir(layerPath), "."+filepath.Base(layerPath)+".tmp")
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		return err
+	}
+
+	o := pulledImg.owner()
+	// Layers are extracted on their own, so only the table can be used
+	if pulledImg.spec.OwnerByName {
+		o.names = newNameResolver("", pulledImg.spec.Names)
+	}
+	// Rootless layers are mounted with the userxattr option
+	userXattr := pulledImg.spec.Rootless
+	s, err := pulledImg.contentStore()
+	if err != nil {
+		return err
+	}
+	// Layers are extracted on their own, so are their limits
+	l := newLimiter(pulledImg.spec.Limits)
+	dirs := make(map[string]dirMeta)
+	err = extractLayer(layer, l, func(tr *tar.Reader) error {
+		return handleOverlayFiles(tr, tmpPath, o, dirs, userXattr, s, l)
+	})
+	if err == nil {
+		err = setDirMetadata(dirs)
+	}
+	if err == nil && !o.rootless {
+		uid, gid := o.root()
+		err = os.Chown(tmpPath, uid, gid)
+	}
+	if err == nil {
+		err = setLabel(tmpPath, o.selinux.Label)
+	}
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	o.names.report()
+	s.report()
+
+	settingsPath := overlaySettingsPath(layerPath)
+	if err := os.Remove(settingsPath); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if err := removeAll(layerPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, layerPath); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(settingsPath, []byte(pulledImg.settings()), 0644))
+}
+
+// Handle the files of a single layer, converting whiteouts to overlayfs
+// whiteouts rather than applying them, in their userxattr form if userXattr
+func handleOverlayFiles(tr *tar.Reader, layerPath string, o owner, dirs map[string]dirMeta, userXattr bool, s *contentStore, l *limiter) error {
+	// Paths added by this layer, relative to layerPath
+	added := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		// Done with this tar layer
+		if err == io.EOF {
+			break
+		}
+		// Something went wrong
+		if err != nil {
+			return err
+		}
+		if err := l.check(hdr); err != nil {
+			return err
+		}
+		// aufs metadata, not part of the rootfs
+		if isWhiteoutMeta(hdr.Name) {
+			log.Debugf("Skipping whiteout metadata %s", hdr.Name)
+			continue
+		}
+		if isWhiteout(filepath.Base(filepath.Clean(hdr.Name))) {
+			if err := overlayWhiteout(layerPath, hdr, added, o, userXattr); err != nil {
+				return err
+			}
+			continue
+		}
+		markAdded(added, filepath.Join("/", hdr.Name))
+		if err := extractFile(layerPath, hdr, tr, o, dirs, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overlayWhiteout converts a whiteout entry to its overlayfs form: a 0/0
+// character device, or an xattr whiteout with userXattr, for a whiteout, and
+// an opaque xattr on the directory for an opaque directory
+func overlayWhiteout(layerPath string, hdr *tar.Header, added map[string]bool, o owner, userXattr bool) error {
+	name := filepath.Join("/", hdr.Name)
+	base := filepath.Base(name)
+	dir := filepath.Dir(name)
+	dirPath, err := followPath(layerPath, dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return err
+	}
+
+	opaqueXattr := overlayOpaqueXattr
+	if userXattr {
+		opaqueXattr = overlayUserOpaqueXattr
+	}
+	if base == whiteoutOpaqueDir {
+		if err := syscall.Setxattr(dirPath, opaqueXattr, []byte("y"), 0); err != nil {
+			return errors.Wrapf(err, "setting %s for %s", opaqueXattr, hdr.Name)
+		}
+		return nil
+	}
+
+	target := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	// A whiteout with an empty name would hide its own directory
+	if target == dir {
+		log.Warnf("Ignoring invalid whiteout %s", hdr.Name)
+		return nil
+	}
+	if added[target] {
+		return nil
+	}
+	path, err := securePath(layerPath, target)
+	if err != nil {
+		return err
+	}
+	if userXattr {
+		if err := xattrWhiteout(dirPath, path); err != nil {
+			return errors.Wrapf(err, "creating overlay whiteout %s", hdr.Name)
+		}
+	} else if err := syscall.Mknod(path, syscall.S_IFCHR, 0); err != nil {
+		return errors.Wrapf(err, "creating overlay whiteout %s", hdr.Name)
+	}
+	if o.rootless {
+		return nil
+	}
+	uid, gid := o.root()
+	return os.Lchown(path, uid, gid)
+}
+
+// xattrWhiteout creates the whiteout at path as an empty file with the
+// whiteout xattr, and marks dirPath as holding such whiteouts, unless it is
+// already opaque
+func xattrWhiteout(dirPath string, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := syscall.Setxattr(path, overlayUserWhiteoutXattr, []byte("y"), 0); err != nil {
+		return err
+	}
+	value := make([]byte, 1)
+	if n, err := syscall.Getxattr(dirPath, overlayUserOpaqueXattr, value); err == nil && string(value[:n]) == "y" {
+		return nil
+	}
+	return syscall.Setxattr(dirPath, overlayUserOpaqueXattr, []byte("x"), 0)
+}
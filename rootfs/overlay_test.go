@@ -0,0 +1,126 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayWhiteouts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating overlay whiteouts requires root")
+	}
+	layerPath, err := ioutil.TempDir("", "layer")
+	require.NoError(t, err)
+	defer os.RemoveAll(layerPath)
+
+	tr := buildTar(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/", Typeflag: tar.TypeDir, Mode: 0700},
+	}, nil)
+	dirs := make(map[string]dirMeta)
+	err = handleOverlayFiles(tr, layerPath, testOwner(), dirs, false, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, setDirMetadata(dirs))
+
+	// Whiteouts are 0/0 character devices
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Lstat(filepath.Join(layerPath, "etc/passwd"), &st))
+	require.Equal(t, uint32(syscall.S_IFCHR), st.Mode&syscall.S_IFMT)
+	require.Equal(t, uint64(0), st.Rdev)
+
+	// But never for entries of the same layer
+	fi, err := os.Lstat(filepath.Join(layerPath, "etc/hosts"))
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+
+	// Opaque directories keep their metadata
+	value := make([]byte, 1)
+	_, err = syscall.Getxattr(filepath.Join(layerPath, "var"), overlayOpaqueXattr, value)
+	require.NoError(t, err)
+	require.Equal(t, "y", string(value))
+	fi, err = os.Stat(filepath.Join(layerPath, "var"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
+
+// Test the whiteouts written for rootless extraction, which don't need any
+// privilege
+func TestOverlayUserWhiteouts(t *testing.T) {
+	layerPath, err := ioutil.TempDir("", "layer")
+	require.NoError(t, err)
+	defer os.RemoveAll(layerPath)
+	if err := syscall.Setxattr(layerPath, overlayUserOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("user xattrs aren't supported: %s", err)
+	}
+
+	tr := buildTar(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/.wh.log", Typeflag: tar.TypeReg, Mode: 0644},
+	}, nil)
+	o := testOwner()
+	o.rootless = true
+	dirs := make(map[string]dirMeta)
+	require.NoError(t, handleOverlayFiles(tr, layerPath, o, dirs, true, nil, nil))
+	require.NoError(t, setDirMetadata(dirs))
+
+	// Whiteouts are empty files with the whiteout xattr
+	for _, name := range []string{"etc/passwd", "var/log"} {
+		fi, err := os.Lstat(filepath.Join(layerPath, name))
+		require.NoError(t, err, name)
+		require.True(t, fi.Mode().IsRegular(), name)
+		require.Equal(t, int64(0), fi.Size(), name)
+		_, err = syscall.Getxattr(filepath.Join(layerPath, name), overlayUserWhiteoutXattr, make([]byte, 1))
+		require.NoError(t, err, name)
+	}
+
+	// In directories marked as holding them, which opaque ones already are
+	for name, want := range map[string]string{"etc": "x", "var": "y"} {
+		value := make([]byte, 1)
+		_, err := syscall.Getxattr(filepath.Join(layerPath, name), overlayUserOpaqueXattr, value)
+		require.NoError(t, err, name)
+		require.Equal(t, want, string(value), name)
+	}
+}
+
+// Test that layers are only reused when extracted with the same settings
+func TestOverlayReuse(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	layer := fileLayer(t, "a")
+	diffID, err := layer.DiffID()
+	require.NoError(t, err)
+	layerPath := filepath.Join(dest, "layers", diffID.Hex)
+	pulledImg := testPulledImage(t, testImage(t, layer), Spec{Dest: dest, Output: OutputOverlay})
+	require.NoError(t, pulledImg.extractOverlay([]v1.Layer{layer}))
+	require.True(t, pulledImg.overlayLayerCurrent(layerPath))
+
+	marker := filepath.Join(layerPath, "marker")
+	require.NoError(t, ioutil.WriteFile(marker, nil, 0644))
+	require.NoError(t, pulledImg.extractOverlay([]v1.Layer{layer}))
+	_, err = os.Stat(marker)
+	require.NoError(t, err)
+
+	pulledImg.spec.IDOverflow = IDOverflowNobody
+	require.False(t, pulledImg.overlayLayerCurrent(layerPath))
+	require.NoError(t, pulledImg.extractOverlay([]v1.Layer{layer}))
+	_, err = os.Stat(marker)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(layerPath, "a"))
+	require.NoError(t, err)
+	require.True(t, pulledImg.overlayLayerCurrent(layerPath))
+}
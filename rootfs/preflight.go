@@ -0,0 +1,254 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// Estimates for the layers which were never extracted to Dest, from their
+// compressed size
+const (
+	// Uncompressed size of a layer per compressed byte, about what gzip
+	// achieves on the binaries and text of a typical image
+	estimatedRatio = 3
+	// Uncompressed bytes per entry, for the inodes a layer needs
+	estimatedEntrySize = 8 << 10
+)
+
+// spaceNeed is the space an extraction needs on a filesystem
+type spaceNeed struct {
+	// The locations written to on the filesystem
+	paths  []string
+	bytes  uint64
+	inodes uint64
+	// What the need is made of, for the error
+	layers     int
+	compressed int64
+	estimated  bool
+}
+
+// preflight checks that the filesystems of Dest and the other locations
+// written to can hold the layers about to be extracted. The size of a layer
+// is the exact one recorded by a previous extraction to Dest if any, and is
+// estimated from its compressed size otherwise.
+func (pulledImg *PulledImage) preflight(layers []v1.Layer) error {
+	spec := pulledImg.spec
+	pending, err := pulledImg.pendingLayers(layers)
+	if err != nil {
+		return err
+	}
+	previous, err := readProvenance(spec.Dest)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]provenanceLayer)
+	if previous != nil && previous.Settings == pulledImg.settings() {
+		for _, layer := range previous.Layers {
+			if layer.Size > 0 {
+				known[layer.DiffID] = layer
+			}
+		}
+	}
+
+	total := &spaceNeed{}
+	// Of each pending layer, for the snapshots
+	var layerBytes, layerInodes []uint64
+	for _, layer := range pending {
+		compressed, err := layer.Size()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		total.layers++
+		total.compressed += compressed
+		bytes, inodes := uint64(compressed)*estimatedRatio, uint64(compressed)*estimatedRatio/estimatedEntrySize+1
+		if exact, ok := known[diffID.String()]; ok {
+			bytes, inodes = uint64(exact.Size), uint64(exact.Entries)
+		} else {
+			total.estimated = true
+		}
+		total.bytes += bytes
+		total.inodes += inodes
+		layerBytes = append(layerBytes, bytes)
+		layerInodes = append(layerInodes, inodes)
+	}
+	if total.layers == 0 {
+		return nil
+	}
+
+	// The layers are extracted in Dest, to the staging directory, where the
+	// previous rootfs is moved to when its layers are reused, or to the
+	// temporary directory the tar and image outputs are written from
+	needs := make(map[syscall.Fsid]*spaceNeed)
+	var fsids []syscall.Fsid
+	add := func(path string, bytes uint64, inodes uint64) error {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			return errors.Wrapf(err, "statfs %s", path)
+		}
+		need, ok := needs[st.Fsid]
+		if !ok {
+			need = &spaceNeed{layers: total.layers, compressed: total.compressed, estimated: total.estimated}
+			needs[st.Fsid] = need
+			fsids = append(fsids, st.Fsid)
+		}
+		need.paths = append(need.paths, path)
+		need.bytes += bytes
+		need.inodes += inodes
+		return nil
+	}
+	if err := add(spec.Dest, total.bytes, total.inodes); err != nil {
+		return err
+	}
+	// The exports don't go through the store, nor does extraction when it
+	// wouldn't be used
+	if spec.Store != "" && (spec.Output == "" || spec.Output == OutputRootfs || spec.Output == OutputOverlay) {
+		s, err := pulledImg.openStore()
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			if err := add(spec.Store, total.bytes, total.inodes); err != nil {
+				return err
+			}
+		}
+	}
+	if spec.Snapshots != "" && (spec.Output == "" || spec.Output == OutputRootfs) {
+		bytes, inodes, err := pulledImg.snapshotNeed(layers, previous, layerBytes, layerInodes)
+		if err != nil {
+			return err
+		}
+		if bytes > 0 {
+			if err := os.MkdirAll(spec.Snapshots, 0755); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := add(spec.Snapshots, bytes, inodes); err != nil {
+				return err
+			}
+		}
+	}
+	if spec.Output == OutputTar && spec.Export.Path != "-" && spec.Export.Path != "" {
+		size := total.bytes
+		if spec.Export.Compression != "" {
+			size = uint64(total.compressed)
+		}
+		if err := add(filepath.Dir(spec.Export.Path), size, 1); err != nil {
+			return err
+		}
+	}
+	if spec.Output == OutputImage && spec.Export.Path != "" {
+		// The layer's tar is written next to the flattened rootfs
+		if err := add(spec.Dest, total.bytes, 1); err != nil {
+			return err
+		}
+		if err := add(filepath.Dir(spec.Export.Path), uint64(total.compressed), 1); err != nil {
+			return err
+		}
+	}
+
+	for _, fsid := range fsids {
+		if err := needs[fsid].check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotNeed is the space the snapshots saved by update need, given the
+// size of each layer, as all of them are extracted with the rootfs output
+func (pulledImg *PulledImage) snapshotNeed(layers []v1.Layer, previous *provenance, layerBytes []uint64, layerInodes []uint64) (uint64, uint64, error) {
+	record, err := pulledImg.newProvenance(layers)
+	if err != nil {
+		return 0, 0, err
+	}
+	var bytes, inodes uint64
+	for n := range snapshotPoints(previous, record) {
+		if n > len(layerBytes) {
+			continue
+		}
+		if _, err := os.Stat(pulledImg.snapshotPath(record, record.Layers[n-1].ChainID)); err == nil {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			bytes += layerBytes[i]
+			inodes += layerInodes[i]
+		}
+	}
+	return bytes, inodes, nil
+}
+
+// pendingLayers are the layers which will be extracted, rather than reused
+// from a previous extraction to Dest
+func (pulledImg *PulledImage) pendingLayers(layers []v1.Layer) ([]v1.Layer, error) {
+	spec := pulledImg.spec
+	switch spec.Output {
+	case "", OutputRootfs:
+		// The previous rootfs is moved, or replaced
+		if spec.Conflict == ConflictReplace {
+			return layers, nil
+		}
+		previous, err := readProvenance(spec.Dest)
+		if err != nil || previous == nil {
+			return layers, err
+		}
+		record, err := pulledImg.newProvenance(layers)
+		if err != nil {
+			return nil, err
+		}
+		if common := commonLayers(previous, record); common == len(previous.Layers) {
+			return layers[common:], nil
+		}
+		return layers, nil
+	case OutputOverlay:
+		var pending []v1.Layer
+		for _, layer := range layers {
+			diffID, err := layer.DiffID()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if !pulledImg.overlayLayerCurrent(filepath.Join(spec.Dest, "layers", diffID.Hex)) {
+				pending = append(pending, layer)
+			}
+		}
+		return pending, nil
+	default:
+		return layers, nil
+	}
+}
+
+// check fails if the filesystem of need's paths can't hold it
+func (need *spaceNeed) check() error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(need.paths[0], &st); err != nil {
+		return errors.Wrapf(err, "statfs %s", need.paths[0])
+	}
+	what := fmt.Sprintf("%d layers, %d bytes compressed", need.layers, need.compressed)
+	if need.estimated {
+		what += fmt.Sprintf(", estimated at %dx", estimatedRatio)
+	}
+	paths := append([]string{}, need.paths...)
+	sort.Strings(paths)
+	where := strings.Join(paths, ", ")
+
+	available := st.Bavail * uint64(st.Bsize)
+	log.Debugf("%s needs %d bytes and %d inodes, %d bytes and %d inodes available", where, need.bytes, need.inodes, available, st.Ffree)
+	if need.bytes > available {
+		return errors.Errorf("not enough space for %s: need %d bytes (%s), only %d available", where, need.bytes, what, available)
+	}
+	// Some filesystems, e.g. btrfs, have no fixed number of inodes
+	if st.Files > 0 && need.inodes > st.Ffree {
+		return errors.Errorf("not enough inodes for %s: need %d (%s), only %d available", where, need.inodes, what, st.Ffree)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package rootfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// hugeLayer claims a compressed size no disk can hold
+type hugeLayer struct {
+	v1.Layer
+}
+
+func (hugeLayer) Size() (int64, error) {
+	return 1 << 60, nil
+}
+
+func TestPreflight(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	a, b := fileLayer(t, "a"), fileLayer(t, "b")
+	pulledImg := testPulledImage(t, testImage(t, a, b), Spec{Dest: dest})
+	require.NoError(t, pulledImg.preflight([]v1.Layer{a, b}))
+
+	err = pulledImg.preflight([]v1.Layer{a, hugeLayer{b}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not enough space for "+dest)
+	require.Contains(t, err.Error(), "2 layers")
+	require.Contains(t, err.Error(), "estimated")
+
+	// The store needs space only when it is used
+	store := filepath.Join(dest, "store")
+	pulledImg.spec.Store = store
+	s, err := pulledImg.openStore()
+	require.NoError(t, err)
+	err = pulledImg.preflight([]v1.Layer{a, hugeLayer{b}})
+	require.Error(t, err)
+	if s == nil {
+		require.Contains(t, err.Error(), "not enough space for "+dest+":")
+	}
+	pulledImg.spec.StoreHardlinks = true
+	err = pulledImg.preflight([]v1.Layer{a, hugeLayer{b}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not enough space for "+dest+", "+store+":")
+	pulledImg.spec.Store, pulledImg.spec.StoreHardlinks = "", false
+
+	// Once extracted, the exact sizes are recorded and used
+	require.NoError(t, pulledImg.extractRootfs([]v1.Layer{a, b}))
+	record, err := readProvenance(dest)
+	require.NoError(t, err)
+	for _, layer := range record.Layers {
+		require.True(t, layer.Size > 0)
+		require.Equal(t, 1, layer.Entries)
+	}
+	pulledImg.spec.Conflict = ConflictReplace
+	require.NoError(t, pulledImg.preflight([]v1.Layer{a, hugeLayer{b}}))
+
+	// Layers which are already extracted need no space
+	pulledImg.spec.Conflict = ""
+	pulledImg.spec.Output = OutputRootfs
+	pending, err := pulledImg.pendingLayers([]v1.Layer{a, b, fileLayer(t, "c")})
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+}
+
+// Test that the snapshots about to be saved are accounted for
+func TestPreflightSnapshots(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	a, b := fileLayer(t, "a"), fileLayer(t, "b")
+	layers := []v1.Layer{a, b}
+	pulledImg := testPulledImage(t, testImage(t, a, b), Spec{Dest: dest, Snapshots: filepath.Join(dest, "snapshots")})
+	bytes, inodes, err := pulledImg.snapshotNeed(layers, nil, []uint64{10, 20}, []uint64{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), bytes)
+	require.Equal(t, uint64(3), inodes)
+	require.NoError(t, pulledImg.preflight(layers))
+
+	// Branching from a previous image also snapshots the shared layers
+	previous, err := pulledImg.newProvenance([]v1.Layer{a, fileLayer(t, "c")})
+	require.NoError(t, err)
+	bytes, _, err = pulledImg.snapshotNeed(layers, previous, []uint64{10, 20}, []uint64{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(40), bytes)
+
+	// Snapshots which exist need no space
+	require.NoError(t, pulledImg.extractRootfs(layers))
+	bytes, _, err = pulledImg.snapshotNeed(layers, nil, []uint64{10, 20}, []uint64{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), bytes)
+}
@@ -0,0 +1,326 @@
+package rootfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// ProvenanceFile is the name of the record, in Dest, of the layers which
+// produced Dest/rootfs
+const ProvenanceFile = "provenance.json"
+
+// provenance records which image and layer chain produced a rootfs
+type provenance struct {
+	// Name and digest of the image
+	Name   string
+	Digest string
+	// Settings which change the extracted files, layers are only reused
+	// when they match
+	Settings string
+	Layers   []provenanceLayer
+	// Paths Spec.Inject added to the rootfs or whited out, parents first,
+	// for commit to take them from the rootfs
+	Injected []string `json:",omitempty"`
+}
+
+// provenanceLayer is a layer of the chain which produced a rootfs
+type provenanceLayer struct {
+	Digest string
+	DiffID string
+	// ChainID identifies the layer along with all the layers below it, see
+	// https://github.com/opencontainers/image-spec/blob/master/config.md#layer-chainid
+	ChainID string
+	// Disk space used by the files extracted from the layer, and how many
+	// there were, zero when unknown. See preflight.
+	Size    int64
+	Entries int
+}
+
+// newProvenance builds the record of the layers about to be extracted
+func (pulledImg *PulledImage) newProvenance(layers []v1.Layer) (*provenance, error) {
+	digest, err := pulledImg.img.Digest()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	record := &provenance{
+		Name:     pulledImg.name,
+		Digest:   digest.String(),
+		Settings: pulledImg.settings(),
+	}
+	chainID := ""
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		chainID = nextChainID(chainID, diffID.String())
+		record.Layers = append(record.Layers, provenanceLayer{
+			Digest:  digest.String(),
+			DiffID:  diffID.String(),
+			ChainID: chainID,
+		})
+	}
+	return record, nil
+}
+
+// settings describes the settings which change the extracted files
+func (pulledImg *PulledImage) settings() string {
+	settings := fmt.Sprintf("uidmap=%s,gidmap=%s", pulledImg.spec.uidMap, pulledImg.spec.gidMap)
+	if pulledImg.spec.IDOverflow != "" {
+		settings += ",overflow=" + pulledImg.spec.IDOverflow
+	}
+	if pulledImg.spec.OwnerByName {
+		// Printing maps sorts their keys
+		settings += fmt.Sprintf(",byname=%v%v", pulledImg.spec.Names.Users, pulledImg.spec.Names.Groups)
+	}
+	if pulledImg.spec.Rootless {
+		settings += ",rootless"
+	}
+	if pulledImg.spec.SELinux.Label != "" {
+		settings += fmt.Sprintf(",selinux=%q", pulledImg.spec.SELinux.Label)
+	}
+	if pulledImg.spec.SELinux.FromLayers {
+		settings += ",selinuxfromlayers"
+	}
+	if len(pulledImg.spec.Include) > 0 {
+		settings += fmt.Sprintf(",include=%q", pulledImg.spec.Include)
+	}
+	if len(pulledImg.spec.Exclude) > 0 {
+		settings += fmt.Sprintf(",exclude=%q", pulledImg.spec.Exclude)
+	}
+	// A kept rootfs holds what was injected into it
+	for _, inj := range pulledImg.spec.Inject {
+		settings += fmt.Sprintf(",inject=%q:%q:%s:%d:%d", inj.Source, inj.Dest, inj.Mode, inj.Uid, inj.Gid)
+	}
+	return settings
+}
+
+// nextChainID computes the chain ID of a layer from the chain ID of the
+// layer below it, empty for the bottom layer, and its diff ID
+func nextChainID(parent string, diffID string) string {
+	if parent == "" {
+		return diffID
+	}
+	sum := sha256.Sum256([]byte(parent + " " + diffID))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// readProvenance reads the record in dest, if any
+func readProvenance(dest string) (*provenance, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dest, ProvenanceFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	record := &provenance{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, errors.Wrapf(err, "reading %s", ProvenanceFile)
+	}
+	return record, nil
+}
+
+// write the record to dest
+func (record *provenance) write(dest string) error {
+	data, err := json.MarshalIndent(record, "", " ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(dest, ProvenanceFile), data, 0644))
+}
+
+// commonLayers is the number of bottom layers two records share
+func commonLayers(a *provenance, b *provenance) int {
+	if a.Settings != b.Settings {
+		return 0
+	}
+	n := 0
+	for n < len(a.Layers) && n < len(b.Layers) && a.Layers[n].ChainID == b.Layers[n].ChainID {
+		n++
+	}
+	return n
+}
+
+// update extracts the layers into rootfsPath and returns their record, for
+// the caller to write once the rootfs is in place. When the rootfs at base,
+// if any, was produced by a previous run, the layers it shares with the new
+// image are reused rather than extracted again.
+func (pulledImg *PulledImage) update(layers []v1.Layer, rootfsPath string, base string) (*provenance, error) {
+	dest := pulledImg.spec.Dest
+	record, err := pulledImg.newProvenance(layers)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := readProvenance(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]dirMeta)
+	start, err := pulledImg.reuse(previous, record, rootfsPath, base, dirs)
+	if err != nil {
+		return nil, err
+	}
+	for i, layer := range record.Layers[:start] {
+		log.Infof("Reusing layer %s", layer.Digest)
+		if previous != nil && i < len(previous.Layers) && previous.Layers[i].ChainID == layer.ChainID {
+			record.Layers[i].Size, record.Layers[i].Entries = previous.Layers[i].Size, previous.Layers[i].Entries
+		}
+	}
+
+	points := snapshotPoints(previous, record)
+	afterLayer := func(i int, stats extractStats) error {
+		layer := &record.Layers[start+i]
+		layer.Size, layer.Entries = stats.allocatedBytes, stats.extracted
+		if pulledImg.spec.Snapshots == "" || !points[start+i+1] {
+			return nil
+		}
+		return pulledImg.saveSnapshot(rootfsPath, record, layer.ChainID, dirs)
+	}
+	if err := pulledImg.flattenFrom(layers[start:], rootfsPath, dirs, afterLayer); err != nil {
+		return nil, err
+	}
+	if record.Injected, err = pulledImg.injectedPaths(rootfsPath); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// snapshotPoints are the numbers of layers of record after which a snapshot
+// is worth saving, rather than after each layer: the whole chain, which the
+// next image may branch from, and the layers record shares with the previous
+// one when they branch, as images alternating between them reuse those.
+func snapshotPoints(previous *provenance, record *provenance) map[int]bool {
+	points := map[int]bool{len(record.Layers): true}
+	if previous == nil {
+		return points
+	}
+	if common := commonLayers(previous, record); common > 0 && common < len(previous.Layers) {
+		points[common] = true
+	}
+	return points
+}
+
+// removeProvenance removes the record in dest, if any
+func removeProvenance(dest string) error {
+	if err := os.Remove(filepath.Join(dest, ProvenanceFile)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// reuse prepares the rootfs for the layers of record which aren't already
+// extracted, and returns how many layers are. The rootfs at base is either
+// kept, when all of its layers are in record, or replaced by the longest
+// snapshot of record's layers. Layers can't be taken off a rootfs, so
+// without a snapshot, a rootfs with layers which aren't in record is
+// extracted from scratch.
+func (pulledImg *PulledImage) reuse(previous *provenance, record *provenance, rootfsPath string, base string, dirs map[string]dirMeta) (int, error) {
+	// Not produced by us, extract on top of whatever is there
+	if previous == nil {
+		return 0, pulledImg.carryRootfs(base, rootfsPath, dirs)
+	}
+
+	common := commonLayers(previous, record)
+	kept := common == len(previous.Layers)
+	start := 0
+	if kept {
+		start = common
+	}
+	// A snapshot may have more layers than the rootfs
+	for n := len(record.Layers); n > start; n-- {
+		snapshot := pulledImg.snapshotPath(record, record.Layers[n-1].ChainID)
+		if _, err := os.Stat(snapshot); err != nil {
+			continue
+		}
+		log.Infof("Restoring snapshot of %d layers from %s", n, snapshot)
+		if err := removeAll(rootfsPath); err != nil {
+			return 0, err
+		}
+		if err := copyTree(snapshot, rootfsPath, nil, dirs); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	if kept {
+		return start, pulledImg.carryRootfs(base, rootfsPath, dirs)
+	}
+	// The rootfs has layers which aren't in the image, start over
+	log.Infof("Rootfs has layers which aren't in %s, extracting from scratch", record.Name)
+	if err := removeAll(rootfsPath); err != nil {
+		return 0, err
+	}
+	return 0, os.MkdirAll(rootfsPath, 0755)
+}
+
+// carryRootfs moves the rootfs at base, if any, to rootfsPath, for more
+// layers to be extracted on top, and records its directories in dirs
+func (pulledImg *PulledImage) carryRootfs(base string, rootfsPath string, dirs map[string]dirMeta) error {
+	if base == "" {
+		return nil
+	}
+	if _, err := os.Lstat(base); os.IsNotExist(err) {
+		return nil
+	}
+	// The record no longer describes what is at base
+	if err := removeProvenance(pulledImg.spec.Dest); err != nil {
+		return err
+	}
+	log.Debugf("Moving the previous rootfs from %s to %s", base, rootfsPath)
+	if err := removeAll(rootfsPath); err != nil {
+		return err
+	}
+	if err := os.Rename(base, rootfsPath); err != nil {
+		return errors.WithStack(err)
+	}
+	return loadDirMetadata(rootfsPath, dirs)
+}
+
+// snapshotPath is where the snapshot of the rootfs after the layer with the
+// given chain ID is kept
+func (pulledImg *PulledImage) snapshotPath(record *provenance, chainID string) string {
+	sum := sha256.Sum256([]byte(chainID + " " + record.Settings))
+	return filepath.Join(pulledImg.spec.Snapshots, hex.EncodeToString(sum[:]))
+}
+
+// saveSnapshot copies the rootfs, as extracted up to the layer with the given
+// chain ID, to the snapshot directory
+func (pulledImg *PulledImage) saveSnapshot(rootfsPath string, record *provenance, chainID string, dirs map[string]dirMeta) error {
+	snapshot := pulledImg.snapshotPath(record, chainID)
+	if _, err := os.Stat(snapshot); err == nil {
+		return nil
+	}
+	log.Debugf("Saving snapshot of layer %s to %s", chainID, snapshot)
+	if err := os.MkdirAll(pulledImg.spec.Snapshots, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	tmpPath := snapshot + ".tmp"
+	if err := removeAll(tmpPath); err != nil {
+		return err
+	}
+	snapshotDirs := make(map[string]dirMeta)
+	err := copyTree(rootfsPath, tmpPath, dirs, snapshotDirs)
+	if err == nil {
+		err = setDirMetadata(snapshotDirs)
+	}
+	if err != nil {
+		removeAll(tmpPath)
+		return err
+	}
+	return errors.WithStack(os.Rename(tmpPath, snapshot))
+}
@@ -0,0 +1,81 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextChainID(t *testing.T) {
+	first := nextChainID("", "sha256:a")
+	require.Equal(t, "sha256:a", first)
+	// sha256("sha256:a sha256:b")
+	second := nextChainID(first, "sha256:b")
+	require.Equal(t, "sha256:970a948bffa8de94d6e22d747ba8c95030e6e546909f98f54e99a13005e173a8", second)
+}
+
+// fileLayer is a layer with a single file
+func fileLayer(t *testing.T, name string) v1.Layer {
+	return testLayer(t, []*tar.Header{
+		{Name: name, Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{name: name})
+}
+
+func TestUpdate(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	rootfs := filepath.Join(dest, "rootfs")
+
+	a, b, c, d := fileLayer(t, "a"), fileLayer(t, "b"), fileLayer(t, "c"), fileLayer(t, "d")
+	extract := func(snapshots string, layers ...v1.Layer) {
+		pulledImg := testPulledImage(t, testImage(t, layers...), Spec{Dest: dest, Snapshots: snapshots})
+		require.NoError(t, pulledImg.extractRootfs(layers))
+	}
+	exists := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(rootfs, name))
+		return err == nil
+	}
+
+	extract("", a, b)
+	require.True(t, exists("a") && exists("b"))
+	record, err := readProvenance(dest)
+	require.NoError(t, err)
+	require.Len(t, record.Layers, 2)
+
+	// New layers on top are applied to the existing rootfs
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "marker"), nil, 0644))
+	extract("", a, b, d)
+	require.True(t, exists("a") && exists("b") && exists("d") && exists("marker"))
+
+	// A different chain starts over
+	extract("", a, c)
+	require.True(t, exists("a") && exists("c"))
+	require.False(t, exists("b") || exists("d") || exists("marker"))
+
+	// With snapshots, the common layers are restored from the snapshot
+	snapshots := filepath.Join(dest, "snapshots")
+	extract(snapshots, a, b)
+	entries, err := ioutil.ReadDir(snapshots)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "marker"), nil, 0644))
+	extract(snapshots, a, c)
+	require.True(t, exists("a") && exists("c"))
+	require.False(t, exists("b") || exists("marker"))
+	extract(snapshots, a, b)
+	require.True(t, exists("a") && exists("b"))
+	require.False(t, exists("c"))
+
+	// Layers below the top one are only snapshotted where images branch,
+	// so a, b, c isn't
+	extract(snapshots, a, b, c, d)
+	entries, err = ioutil.ReadDir(snapshots)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+}
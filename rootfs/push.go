@@ -0,0 +1,161 @@
+package rootfs
+
+import (
+	"os"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/ForAllSecure/rootfs_builder/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// PushableImage contains metadata necessary for pushing images
+type PushableImage struct {
+	// Reference to push the image to
+	Name string
+	// Path to registry cert
+	Cert *string
+	// Number of attempts to retry pushing
+	Retries int
+	// Local image to push, an OCI image layout or a docker-archive, as
+	// written by OutputImage
+	Source string
+	// Tag of the image in an OCI layout holding several
+	Tag string
+	// Image of the same registry whose repository the layers are mounted
+	// from, when it has them, rather than uploaded
+	MountFrom string
+	https     bool
+}
+
+// NewPushableImage initializes a PushableImage spec from a user provided
+// config
+func NewPushableImage(path string) (*PushableImage, error) {
+	var pushableImage PushableImage
+	err := util.UnmarshalFile(path, &pushableImage)
+	if err != nil {
+		return nil, err
+	}
+	if pushableImage.Retries <= 0 {
+		pushableImage.Retries = DefaultRetries
+	}
+	pushableImage.https = true
+	return &pushableImage, nil
+}
+
+// Push the image at Source to the registry
+func (pushable *PushableImage) Push() error {
+	img, err := LoadImage(pushable.Source, pushable.Tag)
+	if err != nil {
+		return err
+	}
+	return pushable.PushImage(img)
+}
+
+// PushImage pushes img to the registry. Its layers which are already in the
+// target repository aren't uploaded again, and with MountFrom, those in its
+// repository are mounted from there.
+func (pushable *PushableImage) PushImage(img v1.Image) error {
+	return withRetries(pushable.Retries, &pushable.https, func() error {
+		return pushable.push(img)
+	})
+}
+
+// push a v1.Image
+func (pushable *PushableImage) push(img v1.Image) error {
+	log.Debugf("Pushing %s", pushable.Name)
+	ref, err := parseReference(pushable.Name, pushable.https)
+	if err != nil {
+		return err
+	}
+	options, err := remoteOptions(pushable.Cert)
+	if err != nil {
+		return err
+	}
+	if pushable.MountFrom != "" {
+		from, err := parseReference(pushable.MountFrom, pushable.https)
+		if err != nil {
+			return err
+		}
+		img = &mountableImage{Image: img, from: from}
+	}
+	if err := remote.Write(ref, img, options...); err != nil {
+		return errors.WithStack(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Infof("Pushed %s@%s", pushable.Name, digest)
+	return nil
+}
+
+// mountableImage marks the layers of an image as mountable from the
+// repository of from, which remote.Write then asks the registry to do
+type mountableImage struct {
+	v1.Image
+	from name.Reference
+}
+
+// Layers implements v1.Image
+func (img *mountableImage) Layers() ([]v1.Layer, error) {
+	layers, err := img.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	mountable := make([]v1.Layer, len(layers))
+	for i, layer := range layers {
+		mountable[i] = &remote.MountableLayer{Layer: layer, Reference: img.from}
+	}
+	return mountable, nil
+}
+
+// LoadImage reads the image at path, an OCI image layout directory or a
+// docker-archive. tag picks the image of a layout or archive holding
+// several.
+func LoadImage(path string, tag string) (v1.Image, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !fi.IsDir() {
+		var ref *name.Tag
+		if tag != "" {
+			t, err := name.NewTag(tag, name.WeakValidation)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			ref = &t
+		}
+		img, err := tarball.ImageFromPath(path, ref)
+		return img, errors.Wrapf(err, "reading docker-archive %s", path)
+	}
+
+	index, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading OCI layout %s", path)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var found []v1.Descriptor
+	for _, desc := range manifest.Manifests {
+		if tag == "" || desc.Annotations[ociRefName] == tag {
+			found = append(found, desc)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, errors.Errorf("no image tagged %q in %s", tag, path)
+	case len(found) > 1 && tag == "":
+		return nil, errors.Errorf("%s holds %d images, set the tag of the one to push", path, len(found))
+	}
+	// The last one added wins
+	img, err := index.Image(found[len(found)-1].Digest)
+	return img, errors.WithStack(err)
+}
@@ -0,0 +1,116 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+)
+
+// repoRegistry wraps the in-process registry, which keeps blobs for all
+// repositories at once, so that each repository only has the blobs pushed
+// or mounted to it, and records the mount requests
+type repoRegistry struct {
+	handler http.Handler
+	mu      sync.Mutex
+	// Digests of the blobs of each repository
+	blobs map[string]map[string]bool
+	// Mount requests, as repository <- from repository@digest
+	mounts []string
+}
+
+func (reg *repoRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := strings.Index(r.URL.Path, "/blobs/")
+	if !strings.HasPrefix(r.URL.Path, "/v2/") || i < 0 {
+		reg.handler.ServeHTTP(w, r)
+		return
+	}
+	repo := r.URL.Path[len("/v2/"):i]
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.blobs[repo] == nil {
+		reg.blobs[repo] = make(map[string]bool)
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead && !reg.blobs[repo][path.Base(r.URL.Path)]:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case r.Method == http.MethodPost && query.Get("mount") != "":
+		digest, from := query.Get("mount"), query.Get("from")
+		reg.mounts = append(reg.mounts, repo+" <- "+from+"@"+digest)
+		if reg.blobs[from][digest] {
+			reg.blobs[repo][digest] = true
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/"+digest)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	case r.Method == http.MethodPut && query.Get("digest") != "":
+		reg.blobs[repo][query.Get("digest")] = true
+	}
+	reg.handler.ServeHTTP(w, r)
+}
+
+func TestPush(t *testing.T) {
+	reg := &repoRegistry{handler: registry.New(), blobs: make(map[string]map[string]bool)}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "push")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	img := testImage(t, testLayer(t, []*tar.Header{
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/motd": "hello"}))
+	source := filepath.Join(dir, "layout")
+	require.NoError(t, writeLayout(source, img, "test"))
+
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	digest, err := layers[0].Digest()
+	require.NoError(t, err)
+	push := func(target string, mountFrom string) {
+		pushable := &PushableImage{Name: u.Host + target, Source: source, Retries: 1, MountFrom: mountFrom, https: true}
+		require.NoError(t, pushable.Push())
+		ref, err := name.ParseReference(pushable.Name, name.WeakValidation)
+		require.NoError(t, err)
+		pushed, err := remote.Image(ref)
+		require.NoError(t, err)
+		want, err := img.Digest()
+		require.NoError(t, err)
+		got, err := pushed.Digest()
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	// The layer is uploaded, then mounted from there
+	push("/test/a:latest", "")
+	require.Empty(t, reg.mounts)
+	push("/test/b:latest", u.Host+"/test/a:latest")
+	require.Equal(t, []string{"test/b <- test/a@" + digest.String()}, reg.mounts)
+	// Or uploaded when the repository doesn't have it
+	push("/test/c:latest", u.Host+"/test/other:latest")
+	require.Equal(t, "test/c <- test/other@"+digest.String(), reg.mounts[1])
+	require.True(t, reg.blobs["test/c"][digest.String()])
+
+	// A layout with several images needs a tag
+	require.NoError(t, writeLayout(source, img, "other"))
+	_, err = LoadImage(source, "")
+	require.Error(t, err)
+	_, err = LoadImage(source, "other")
+	require.NoError(t, err)
+}
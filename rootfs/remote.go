@@ -0,0 +1,134 @@
+package rootfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+)
+
+// withRetries calls attempt until it succeeds, up to retries times, backing
+// off between attempts. https is cleared when the registry turns out to only
+// speak HTTP, for the next attempts.
+func withRetries(retries int, https *bool, attempt func() error) error {
+	var err error
+	for i := 0; i < retries; i++ {
+		err = attempt()
+		if err == nil {
+			break
+		}
+		if strings.Contains(err.Error(), "http: server gave HTTP response to HTTPS client") {
+			log.Info("Retrying with HTTP")
+			*https = false
+		}
+		// This is a v1 schema, give up early
+		if strings.Contains(err.Error(), "unsupported MediaType") {
+			err = errors.WithMessage(err, "Image is v1 schema and too old to support")
+			break
+		}
+		// Either we are unauthorized, or this is a bad registry/image name
+		if strings.Contains(err.Error(), "UNAUTHORIZED: authentication required") {
+			break
+		}
+		// If we get a i/o timeout, it's either intermittent network failure
+		// or an incorrect ip address etc. This means we've already failed 5
+		// retries internal to go-containerregistry, so fail
+		if strings.Contains(err.Error(), "i/o timeout") {
+			log.Warnf("Connection to server timed out %s", err)
+			break
+		}
+		switch err := errors.Cause(err).(type) {
+		case *transport.Error:
+			break
+		default:
+			log.Warnf("Unrecognized error: %s Trying again", err)
+		}
+
+		backoff := math.Pow(2, float64(i))
+		backoff = math.Min(backoff, MaxBackoff)
+		time.Sleep(time.Second * time.Duration(backoff))
+	}
+	return err
+}
+
+// parseReference parses an image reference, over plain HTTP unless https
+func parseReference(imageName string, https bool) (name.Reference, error) {
+	ref, err := name.ParseReference(imageName, name.WeakValidation)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	registryName := ref.Context().RegistryStr()
+
+	var newReg name.Registry
+	if https {
+		newReg, err = name.NewRegistry(registryName, name.WeakValidation)
+	} else {
+		newReg, err = name.NewRegistry(registryName, name.Insecure)
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if tag, ok := ref.(name.Tag); ok {
+		tag.Repository.Registry = newReg
+		ref = tag
+	}
+	if digest, ok := ref.(name.Digest); ok {
+		digest.Repository.Registry = newReg
+		ref = digest
+	}
+	return ref, nil
+}
+
+// remoteOptions sets up the transport, trusting cert if set, and the
+// credentials to talk to registries with
+func remoteOptions(cert *string) ([]remote.Option, error) {
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.DialContext = (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 10 * time.Second,
+		DualStack: true,
+	}).DialContext
+	// A cert was provided
+	if cert != nil {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+		if rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		// Read in the cert file
+		certs, err := ioutil.ReadFile(*cert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read file %s to add to RootCAs", *cert)
+		}
+		// Append our cert to the system pool
+		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+			return nil, errors.Wrap(err, "Failed to append registry certificate")
+		}
+
+		// Trust the augmented cert pool in our client
+		config := &tls.Config{
+			RootCAs: rootCAs,
+		}
+
+		transport.TLSClientConfig = config
+	}
+	transportOption := remote.WithTransport(transport)
+
+	authnOption := remote.WithAuthFromKeychain(authn.NewMultiKeychain(authn.DefaultKeychain))
+	return []remote.Option{transportOption, authnOption}, nil
+}
@@ -0,0 +1,80 @@
+package rootfs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSymlinks is how many symlinks resolving a path may go through, like
+// the kernel's limit
+const maxSymlinks = 40
+
+// securePath is the host path of name, a path in the tree at root, with its
+// parent directories resolved as if root were the filesystem root: symlinks
+// are followed, absolute ones from root, and .. stops at root. The last
+// component is left alone, so that entries replace a symlink rather than
+// write through it. Names which climb out of root with .. are rejected.
+func securePath(root string, name string) (string, error) {
+	return resolveInRoot(root, name, false)
+}
+
+// followPath is securePath, also following the last component when it is a
+// symlink, to read the file a path of the tree refers to
+func followPath(root string, name string) (string, error) {
+	return resolveInRoot(root, name, true)
+}
+
+// resolveInRoot resolves name in the tree at root, see securePath
+func resolveInRoot(root string, name string, followLast bool) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.Errorf("%s is outside of the rootfs", name)
+	}
+	if clean == "." {
+		return root, nil
+	}
+
+	// current is resolved and relative to root, pending is what's left
+	current := ""
+	pending := strings.Split(clean, "/")
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = strings.TrimPrefix(path.Dir("/"+current), "/")
+			continue
+		}
+		next := path.Join(current, part)
+		if len(pending) == 0 && !followLast {
+			current = next
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(root, next))
+		// The rest is created as plain directories
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", errors.Errorf("too many levels of symbolic links in %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if path.IsAbs(target) {
+			current = ""
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, filepath.FromSlash(current)), nil
+}
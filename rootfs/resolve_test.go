@@ -0,0 +1,159 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurePath(t *testing.T) {
+	root, err := ioutil.TempDir("", "root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755))
+	require.NoError(t, os.Symlink("/usr/lib", filepath.Join(root, "lib")))
+	require.NoError(t, os.Symlink("../../..", filepath.Join(root, "usr", "up")))
+	require.NoError(t, os.Symlink("/etc/shadow", filepath.Join(root, "passwd")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(root, "loop")))
+
+	for _, test := range []struct {
+		name   string
+		follow bool
+		want   string
+	}{
+		{name: "/", want: ""},
+		{name: "usr/lib/libc.so", want: "usr/lib/libc.so"},
+		// Absolute symlinks are followed from the root
+		{name: "lib/libc.so", want: "usr/lib/libc.so"},
+		// .. stops at the root
+		{name: "usr/up/etc/passwd", want: "etc/passwd"},
+		// The last component is only followed when asked to
+		{name: "lib", want: "lib"},
+		{name: "lib", follow: true, want: "usr/lib"},
+		{name: "passwd", follow: true, want: "etc/shadow"},
+	} {
+		got, err := resolveInRoot(root, test.name, test.follow)
+		require.NoError(t, err, test.name)
+		require.Equal(t, filepath.Join(root, test.want), got, test.name)
+	}
+	for _, name := range []string{"../etc/passwd", "usr/../../etc/passwd", ".."} {
+		_, err := securePath(root, name)
+		require.Error(t, err, name)
+	}
+	_, err = followPath(root, "loop")
+	require.Error(t, err)
+}
+
+// Test that entries can't write, link or remove anything outside the rootfs
+func TestExtractEscapes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "escape")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	host := filepath.Join(dir, "host")
+	require.NoError(t, os.Mkdir(host, 0755))
+	secret := filepath.Join(host, "secret")
+	require.NoError(t, ioutil.WriteFile(secret, []byte("secret"), 0600))
+
+	for _, test := range []struct {
+		name string
+		hdrs []*tar.Header
+		// Whether extraction fails, rather than staying in the rootfs
+		fails bool
+	}{
+		{
+			name:  "dotdot",
+			hdrs:  []*tar.Header{{Name: "../host/secret", Typeflag: tar.TypeReg, Mode: 0644}},
+			fails: true,
+		},
+		{
+			name:  "dotdot hard link",
+			hdrs:  []*tar.Header{{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "../host/secret"}},
+			fails: true,
+		},
+		{
+			// The link target is in the rootfs, where it doesn't exist
+			name:  "absolute hard link",
+			hdrs:  []*tar.Header{{Name: "stolen", Typeflag: tar.TypeLink, Linkname: secret}},
+			fails: true,
+		},
+		{
+			name: "symlinked parent",
+			hdrs: []*tar.Header{
+				{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+				{Name: "etc/secret", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "etc/dir/", Typeflag: tar.TypeDir, Mode: 0700},
+			},
+		},
+		{
+			name: "symlinked parent hard link",
+			hdrs: []*tar.Header{
+				{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+				{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "etc/secret"},
+			},
+			fails: true,
+		},
+		{
+			name: "symlinked parent whiteout",
+			hdrs: []*tar.Header{
+				{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../" + host},
+				{Name: "etc/.wh.secret", Typeflag: tar.TypeReg},
+				{Name: "etc/.wh..wh..opq", Typeflag: tar.TypeReg},
+			},
+		},
+	} {
+		rootfs := filepath.Join(dir, "rootfs")
+		require.NoError(t, os.RemoveAll(rootfs))
+		require.NoError(t, os.Mkdir(rootfs, 0755))
+
+		contents := map[string]string{"../host/secret": "pwned", "etc/secret": "pwned"}
+		dirs := make(map[string]dirMeta)
+		err := handleFiles(buildTar(t, test.hdrs, contents), rootfs, testOwner(), dirs, nil, nil, nil)
+		if err == nil {
+			err = setDirMetadata(dirs)
+		}
+		if test.fails {
+			require.Error(t, err, test.name)
+		} else {
+			require.NoError(t, err, test.name)
+		}
+
+		data, err := ioutil.ReadFile(secret)
+		require.NoError(t, err, test.name)
+		require.Equal(t, "secret", string(data), test.name)
+		fi, err := os.Stat(secret)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), fi.Mode(), test.name)
+		entries, err := ioutil.ReadDir(host)
+		require.NoError(t, err)
+		require.Len(t, entries, 1, test.name)
+	}
+}
+
+// Test that data after the end of a layer's tar isn't decompressed forever
+func TestTrailingData(t *testing.T) {
+	data := tarBytes(t, []*tar.Header{
+		{Name: "motd", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"motd": "hello"})
+	data = append(data, bytes.Repeat([]byte{0}, 2*maxTrailingBytes)...)
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	require.NoError(t, err)
+
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+	err = extractLayer(layer, nil, func(tr *tar.Reader) error {
+		return handleFiles(tr, rootfs, testOwner(), make(map[string]dirMeta), nil, nil, nil)
+	})
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "after the end of its tar"), err.Error())
+}
@@ -0,0 +1,151 @@
+package rootfs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/pkg/errors"
+)
+
+// rootlessXattr records the ownership a file would have in the image when
+// extracting rootless, as rootless runc and umoci do, see
+// https://github.com/rootless-containers/proto
+const rootlessXattr = "user.rootlesscontainers"
+
+// chown applies the ownership of meta to path, or records it in the
+// rootlesscontainers xattr when rootless
+func (meta dirMeta) chown(path string) error {
+	if !meta.rootless {
+		return os.Lchown(path, meta.uid, meta.gid)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	// user xattrs aren't allowed on symlinks
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return setRootlessOwner(path, meta.uid, meta.gid)
+}
+
+// chmod applies the mode of meta to path. When rootless, the mode is best
+// effort: the caller may not be allowed to set some bits.
+func (meta dirMeta) chmod(path string) error {
+	err := os.Chmod(path, meta.mode)
+	if err != nil && meta.rootless && os.IsPermission(err) {
+		log.Warnf("Failed to set the mode of %s to %s: %s", path, meta.mode, err)
+		return nil
+	}
+	return err
+}
+
+// setRootlessOwner records uid and gid in the rootlesscontainers xattr of
+// path. Root ownership is the default, so it is recorded by removing it.
+func setRootlessOwner(path string, uid int, gid int) error {
+	if uid == 0 && gid == 0 {
+		err := syscall.Removexattr(path, rootlessXattr)
+		if err != nil && err != syscall.ENODATA && err != syscall.ENOTSUP {
+			return errors.Wrapf(err, "removing %s of %s", rootlessXattr, path)
+		}
+		return nil
+	}
+	if err := syscall.Setxattr(path, rootlessXattr, encodeRootless(uid, gid), 0); err != nil {
+		return errors.Wrapf(err, "setting %s of %s", rootlessXattr, path)
+	}
+	return nil
+}
+
+// rootlessOwner reads the ownership recorded in the rootlesscontainers xattr
+// of path, root if there is none
+func rootlessOwner(path string) (int, int, error) {
+	value, err := lgetxattr(path, rootlessXattr)
+	if perr, ok := errors.Cause(err).(*os.PathError); ok && (perr.Err == syscall.ENODATA || perr.Err == syscall.ENOTSUP) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return decodeRootless(value)
+}
+
+// encodeRootless encodes the Resource protobuf message of the
+// rootlesscontainers xattr:
+//
+//	message Resource {
+//	  uint32 uid = 1;
+//	  uint32 gid = 2;
+//	}
+//
+// As in proto3, fields with the default value of 0 are omitted.
+func encodeRootless(uid int, gid int) []byte {
+	var buf []byte
+	if uid != 0 {
+		buf = append(buf, 1<<3)
+		buf = appendVarint(buf, uint64(uint32(uid)))
+	}
+	if gid != 0 {
+		buf = append(buf, 2<<3)
+		buf = appendVarint(buf, uint64(uint32(gid)))
+	}
+	return buf
+}
+
+// decodeRootless decodes the Resource protobuf message, skipping unknown
+// fields
+func decodeRootless(buf []byte) (int, int, error) {
+	var uid, gid uint64
+	for len(buf) > 0 {
+		key, n := readVarint(buf)
+		if n == 0 {
+			return 0, 0, errors.New("invalid rootlesscontainers xattr")
+		}
+		buf = buf[n:]
+		field, wireType := key>>3, key&7
+		switch wireType {
+		case 0:
+			value, n := readVarint(buf)
+			if n == 0 {
+				return 0, 0, errors.New("invalid rootlesscontainers xattr")
+			}
+			buf = buf[n:]
+			if field == 1 {
+				uid = value
+			} else if field == 2 {
+				gid = value
+			}
+		case 2:
+			size, n := readVarint(buf)
+			if n == 0 || uint64(len(buf)-n) < size {
+				return 0, 0, errors.New("invalid rootlesscontainers xattr")
+			}
+			buf = buf[n+int(size):]
+		default:
+			return 0, 0, errors.Errorf("unsupported wire type %d in rootlesscontainers xattr", wireType)
+		}
+	}
+	return int(uint32(uid)), int(uint32(gid)), nil
+}
+
+// appendVarint appends the protobuf varint encoding of v
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// readVarint decodes a protobuf varint, and returns the number of bytes
+// read, 0 if buf doesn't start with a valid varint
+func readVarint(buf []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(buf) && i < 10; i++ {
+		v |= uint64(buf[i]&0x7f) << (7 * uint(i))
+		if buf[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
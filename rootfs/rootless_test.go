@@ -0,0 +1,97 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootlessEncoding(t *testing.T) {
+	require.Equal(t, []byte{0x08, 0xe8, 0x07, 0x10, 0xe8, 0x07}, encodeRootless(1000, 1000))
+	require.Equal(t, []byte{0x10, 0x2a}, encodeRootless(0, 42))
+	require.Empty(t, encodeRootless(0, 0))
+
+	for _, ids := range [][2]int{{0, 0}, {1000, 1000}, {0, 42}, {65534, 65534}, {100000, 5}} {
+		uid, gid, err := decodeRootless(encodeRootless(ids[0], ids[1]))
+		require.NoError(t, err)
+		require.Equal(t, ids, [2]int{uid, gid})
+	}
+
+	// Unknown fields are skipped
+	uid, gid, err := decodeRootless([]byte{0x1a, 0x01, 0xff, 0x08, 0x05})
+	require.NoError(t, err)
+	require.Equal(t, [2]int{5, 0}, [2]int{uid, gid})
+	_, _, err = decodeRootless([]byte{0x08, 0xe8})
+	require.Error(t, err)
+}
+
+// Test that rootless extraction keeps the files owned by us, records the
+// image's ownership in the xattr, and that exporting the tree restores it
+func TestRootlessExtraction(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+	if err := syscall.Setxattr(rootfs, rootlessXattr, []byte{}, 0); err == syscall.ENOTSUP {
+		t.Skip("user xattrs aren't supported")
+	}
+	require.NoError(t, syscall.Removexattr(rootfs, rootlessXattr))
+
+	mtime := time.Unix(1500000000, 0)
+	tr := buildTar(t, []*tar.Header{
+		{Name: "home/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "home/user/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000, ModTime: mtime},
+		{Name: "home/user/file", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 100, ModTime: mtime},
+		{Name: "home/user/link", Typeflag: tar.TypeSymlink, Linkname: "file", Uid: 1000, Gid: 1000, ModTime: mtime},
+		{Name: "su", Typeflag: tar.TypeReg, Mode: 04755, ModTime: mtime},
+	}, map[string]string{"home/user/file": "hello", "su": "su"})
+	dirs := make(map[string]dirMeta)
+	require.NoError(t, handleFiles(tr, rootfs, owner{rootless: true}, dirs, nil, nil, nil))
+	require.NoError(t, setDirMetadata(dirs))
+
+	for _, name := range []string{"home", "home/user", "home/user/file", "home/user/link", "su"} {
+		fi, err := os.Lstat(filepath.Join(rootfs, name))
+		require.NoError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		require.Equal(t, os.Getuid(), int(st.Uid), name)
+	}
+	uid, gid, err := rootlessOwner(filepath.Join(rootfs, "home/user/file"))
+	require.NoError(t, err)
+	require.Equal(t, [2]int{1000, 100}, [2]int{uid, gid})
+	uid, gid, err = rootlessOwner(filepath.Join(rootfs, "home/user"))
+	require.NoError(t, err)
+	require.Equal(t, [2]int{1000, 1000}, [2]int{uid, gid})
+	_, err = lgetxattr(filepath.Join(rootfs, "su"), rootlessXattr)
+	require.Error(t, err)
+
+	fi, err := os.Stat(filepath.Join(rootfs, "su"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSetuid|0755, fi.Mode())
+
+	var buf bytes.Buffer
+	require.NoError(t, writeTar(&buf, rootfs, owner{rootless: true}))
+	owners := make(map[string][2]int)
+	reader := tar.NewReader(&buf)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		owners[hdr.Name] = [2]int{hdr.Uid, hdr.Gid}
+	}
+	require.Equal(t, map[string][2]int{
+		"home/":          {0, 0},
+		"home/user/":     {1000, 1000},
+		"home/user/file": {1000, 100},
+		"home/user/link": {0, 0},
+		"su":             {0, 0},
+	}, owners)
+}
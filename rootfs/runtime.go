@@ -0,0 +1,366 @@
+package rootfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/ForAllSecure/rootfs_builder/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// Runtime overrides the defaults of the generated runtime config.json
+type Runtime struct {
+	// Process args, instead of the image's Entrypoint and Cmd
+	Args []string
+	// Environment variables, added to the image's or replacing those of
+	// the same name
+	Env []string
+	// Working directory, instead of the image's
+	Cwd string
+	// User to run as, instead of the image's, in the same format
+	User string
+	// Hostname of the container
+	Hostname string
+	// Allocate a terminal for the process
+	Terminal bool
+	// Mount the rootfs read-only
+	Readonly bool
+}
+
+// runtimeSpecVersion is the version of the OCI runtime spec we generate
+const runtimeSpecVersion = "1.0.2"
+
+// defaultPath is used when the image doesn't set PATH
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// defaultArgs is used when neither the image nor Runtime.Args set any
+var defaultArgs = []string{"sh"}
+
+// defaultHostname is used unless Runtime.Hostname is set
+const defaultHostname = "rootfs_builder"
+
+// The subset of the OCI runtime spec we generate, see
+// https://github.com/opencontainers/runtime-spec/blob/master/config.md
+type runtimeSpec struct {
+	OCIVersion string         `json:"ociVersion"`
+	Process    runtimeProcess `json:"process"`
+	Root       runtimeRoot    `json:"root"`
+	Hostname   string         `json:"hostname,omitempty"`
+	Mounts     []runtimeMount `json:"mounts"`
+	Linux      runtimeLinux   `json:"linux"`
+}
+
+type runtimeProcess struct {
+	Terminal        bool                `json:"terminal"`
+	User            runtimeUser         `json:"user"`
+	Args            []string            `json:"args"`
+	Env             []string            `json:"env"`
+	Cwd             string              `json:"cwd"`
+	Capabilities    runtimeCapabilities `json:"capabilities"`
+	Rlimits         []runtimeRlimit     `json:"rlimits"`
+	NoNewPrivileges bool                `json:"noNewPrivileges"`
+}
+
+type runtimeUser struct {
+	UID            int   `json:"uid"`
+	GID            int   `json:"gid"`
+	AdditionalGids []int `json:"additionalGids,omitempty"`
+}
+
+type runtimeCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable"`
+	Permitted   []string `json:"permitted"`
+	Ambient     []string `json:"ambient"`
+}
+
+type runtimeRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type runtimeRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type runtimeMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type runtimeLinux struct {
+	UIDMappings   []IDMapping        `json:"uidMappings,omitempty"`
+	GIDMappings   []IDMapping        `json:"gidMappings,omitempty"`
+	Resources     runtimeResources   `json:"resources"`
+	Namespaces    []runtimeNamespace `json:"namespaces"`
+	MaskedPaths   []string           `json:"maskedPaths"`
+	ReadonlyPaths []string           `json:"readonlyPaths"`
+}
+
+type runtimeResources struct {
+	Devices []runtimeDevice `json:"devices"`
+}
+
+type runtimeDevice struct {
+	Allow  bool   `json:"allow"`
+	Access string `json:"access"`
+}
+
+type runtimeNamespace struct {
+	Type string `json:"type"`
+}
+
+// defaultRuntimeSpec is the same as what `runc spec` generates
+func defaultRuntimeSpec() runtimeSpec {
+	caps := []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+	return runtimeSpec{
+		OCIVersion: runtimeSpecVersion,
+		Process: runtimeProcess{
+			Cwd: "/",
+			Capabilities: runtimeCapabilities{
+				Bounding:    caps,
+				Effective:   caps,
+				Inheritable: caps,
+				Permitted:   caps,
+				Ambient:     caps,
+			},
+			Rlimits:         []runtimeRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root:     runtimeRoot{Path: "rootfs"},
+		Hostname: defaultHostname,
+		Mounts: []runtimeMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs",
+				Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts",
+				Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm",
+				Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue",
+				Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs",
+				Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup",
+				Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Linux: runtimeLinux{
+			Resources: runtimeResources{
+				Devices: []runtimeDevice{{Allow: false, Access: "rwm"}},
+			},
+			Namespaces: []runtimeNamespace{
+				{Type: "pid"}, {Type: "network"}, {Type: "ipc"}, {Type: "uts"}, {Type: "mount"},
+			},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+				"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}
+}
+
+// writeRuntimeConfig generates the runtime config.json for the rootfs at
+// rootfsPath from the image config, so that Dest is a bundle runc can run
+func (pulledImg *PulledImage) writeRuntimeConfig(rootfsPath string) error {
+	configFile, err := getConfig(pulledImg.img)
+	if err != nil {
+		return err
+	}
+	spec, err := pulledImg.runtimeSpec(configFile.Config, rootfsPath)
+	if err != nil {
+		return err
+	}
+	jdata, err := json.MarshalIndent(spec, "", " ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	configPath := filepath.Join(pulledImg.spec.Dest, "config.json")
+	return errors.WithStack(ioutil.WriteFile(configPath, jdata, 0644))
+}
+
+// runtimeSpec builds the runtime spec from the image config and the overrides
+// in Spec.Runtime
+func (pulledImg *PulledImage) runtimeSpec(config v1.Config, rootfsPath string) (runtimeSpec, error) {
+	overrides := pulledImg.spec.Runtime
+	spec := defaultRuntimeSpec()
+
+	spec.Process.Args = append(append([]string{}, config.Entrypoint...), config.Cmd...)
+	if len(overrides.Args) > 0 {
+		spec.Process.Args = overrides.Args
+	}
+	if len(spec.Process.Args) == 0 {
+		log.Warnf("Image has no Entrypoint or Cmd, running %s", defaultArgs)
+		spec.Process.Args = defaultArgs
+	}
+
+	spec.Process.Env = mergeEnv(config.Env, overrides.Env)
+	if !hasEnv(spec.Process.Env, "PATH") {
+		spec.Process.Env = append([]string{defaultPath}, spec.Process.Env...)
+	}
+	spec.Process.Terminal = overrides.Terminal
+	if overrides.Terminal && !hasEnv(spec.Process.Env, "TERM") {
+		spec.Process.Env = append(spec.Process.Env, "TERM=xterm")
+	}
+
+	if config.WorkingDir != "" {
+		spec.Process.Cwd = config.WorkingDir
+	}
+	if overrides.Cwd != "" {
+		spec.Process.Cwd = overrides.Cwd
+	}
+
+	userSpec := config.User
+	if overrides.User != "" {
+		userSpec = overrides.User
+	}
+	user, err := resolveUser(rootfsPath, userSpec)
+	if err != nil {
+		return spec, err
+	}
+	spec.Process.User = user
+
+	if overrides.Hostname != "" {
+		spec.Hostname = overrides.Hostname
+	}
+	spec.Root.Readonly = overrides.Readonly
+
+	// Map root to the invoking user, who owns the files
+	if pulledImg.spec.Rootless {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, runtimeNamespace{Type: "user"})
+		spec.Linux.UIDMappings = []IDMapping{{ContainerID: 0, HostID: uint32(os.Getuid()), Size: 1}}
+		spec.Linux.GIDMappings = []IDMapping{{ContainerID: 0, HostID: uint32(os.Getgid()), Size: 1}}
+	}
+	if pulledImg.spec.UseSubuid || len(pulledImg.spec.UIDMappings) > 0 || len(pulledImg.spec.GIDMappings) > 0 {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, runtimeNamespace{Type: "user"})
+		spec.Linux.UIDMappings = pulledImg.spec.uidMap
+		spec.Linux.GIDMappings = pulledImg.spec.gidMap
+	}
+	return spec, nil
+}
+
+// mergeEnv returns env with the variables of overrides, which replace those
+// of the same name in place and are otherwise appended
+func mergeEnv(env []string, overrides []string) []string {
+	merged := append([]string{}, env...)
+	for _, override := range overrides {
+		name := strings.SplitN(override, "=", 2)[0]
+		replaced := false
+		for i, e := range merged {
+			if strings.SplitN(e, "=", 2)[0] == name {
+				merged[i] = override
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, override)
+		}
+	}
+	return merged
+}
+
+// hasEnv reports whether env sets the variable name
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveUser resolves the image config's user, in the form user, uid,
+// user:group or uid:gid, against the rootfs /etc/passwd and /etc/group,
+// following the image's symlinks in the rootfs
+func resolveUser(rootfsPath string, userSpec string) (runtimeUser, error) {
+	var result runtimeUser
+	passwdPath, err := followPath(rootfsPath, "etc/passwd")
+	if err != nil {
+		return result, err
+	}
+	users, err := util.ParsePasswdFile(passwdPath)
+	if err != nil {
+		return result, err
+	}
+	groupPath, err := followPath(rootfsPath, "etc/group")
+	if err != nil {
+		return result, err
+	}
+	groups, err := util.ParseGroupFile(groupPath)
+	if err != nil {
+		return result, err
+	}
+
+	userPart, groupPart := userSpec, ""
+	if i := strings.Index(userSpec, ":"); i >= 0 {
+		userPart, groupPart = userSpec[:i], userSpec[i+1:]
+	}
+
+	// Default to root, and to the user's primary group
+	if userPart == "" {
+		userPart = "0"
+	}
+	userName := ""
+	found := false
+	for _, u := range users {
+		if u.Name == userPart || strconv.Itoa(u.Uid) == userPart {
+			result.UID, result.GID, userName = u.Uid, u.Gid, u.Name
+			found = true
+			break
+		}
+	}
+	if !found {
+		uid, err := strconv.Atoi(userPart)
+		if err != nil {
+			return result, errors.Errorf("user %s not found in the image's /etc/passwd", userPart)
+		}
+		result.UID = uid
+	}
+
+	if groupPart != "" {
+		found = false
+		for _, g := range groups {
+			if g.Name == groupPart || strconv.Itoa(g.Gid) == groupPart {
+				result.GID = g.Gid
+				found = true
+				break
+			}
+		}
+		if !found {
+			gid, err := strconv.Atoi(groupPart)
+			if err != nil {
+				return result, errors.Errorf("group %s not found in the image's /etc/group", groupPart)
+			}
+			result.GID = gid
+		}
+	}
+
+	// Supplementary groups, as initgroups would set them
+	if userName != "" {
+		for _, g := range groups {
+			if g.Gid == result.GID {
+				continue
+			}
+			for _, member := range g.Members {
+				if member == userName {
+					result.AdditionalGids = append(result.AdditionalGids, g.Gid)
+					break
+				}
+			}
+		}
+	}
+	return result, nil
+}
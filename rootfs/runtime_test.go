@@ -0,0 +1,103 @@
+package rootfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/sh
+# comment
+nginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin
+`
+
+const testGroup = `root:x:0:
+www-data:x:33:nginx
+nginx:x:101:
+adm:x:4:root,nginx
+`
+
+func TestResolveUser(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+	require.NoError(t, os.Mkdir(filepath.Join(rootfs, "etc"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "etc/passwd"), []byte(testPasswd), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "etc/group"), []byte(testGroup), 0644))
+
+	tests := []struct {
+		user     string
+		expected runtimeUser
+	}{
+		{"", runtimeUser{UID: 0, GID: 0, AdditionalGids: []int{4}}},
+		{"nginx", runtimeUser{UID: 101, GID: 101, AdditionalGids: []int{33, 4}}},
+		{"101", runtimeUser{UID: 101, GID: 101, AdditionalGids: []int{33, 4}}},
+		{"nginx:www-data", runtimeUser{UID: 101, GID: 33, AdditionalGids: []int{4}}},
+		{"1000", runtimeUser{UID: 1000, GID: 0}},
+		{"1000:1000", runtimeUser{UID: 1000, GID: 1000}},
+	}
+	for _, test := range tests {
+		user, err := resolveUser(rootfs, test.user)
+		require.NoError(t, err, test.user)
+		require.Equal(t, test.expected, user, test.user)
+	}
+
+	_, err = resolveUser(rootfs, "nobody")
+	require.Error(t, err)
+	_, err = resolveUser(rootfs, "root:nogroup")
+	require.Error(t, err)
+
+	// The image's symlinks are followed in the rootfs, never to the host's
+	host, err := ioutil.TempDir("", "host")
+	require.NoError(t, err)
+	defer os.RemoveAll(host)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(host, "passwd"), []byte("nginx:x:0:0::/:/bin/sh\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(host, "group"), []byte(testGroup), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, host), 0755))
+	require.NoError(t, os.Rename(filepath.Join(rootfs, "etc/passwd"), filepath.Join(rootfs, host, "passwd")))
+	require.NoError(t, os.Symlink(filepath.Join(host, "passwd"), filepath.Join(rootfs, "etc/passwd")))
+	user, err := resolveUser(rootfs, "nginx")
+	require.NoError(t, err)
+	require.Equal(t, 101, user.UID)
+}
+
+func TestRuntimeSpec(t *testing.T) {
+	pulledImg := &PulledImage{spec: Spec{
+		UseSubuid: true,
+		uidMap:    idMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		gidMap:    idMap{{ContainerID: 0, HostID: 200000, Size: 65536}, {ContainerID: 65536, HostID: 300000, Size: 1000}},
+		Runtime:   Runtime{Env: []string{"FOO=bar"}, Hostname: "test"},
+	}}
+	config := v1.Config{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		Env:        []string{"NGINX_VERSION=1.17"},
+		WorkingDir: "/srv",
+	}
+	spec, err := pulledImg.runtimeSpec(config, "/nonexistent")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/docker-entrypoint.sh", "nginx", "-g", "daemon off;"}, spec.Process.Args)
+	require.Equal(t, []string{defaultPath, "NGINX_VERSION=1.17", "FOO=bar"}, spec.Process.Env)
+	require.Equal(t, "/srv", spec.Process.Cwd)
+	require.Equal(t, "test", spec.Hostname)
+	require.Equal(t, "rootfs", spec.Root.Path)
+	require.Contains(t, spec.Linux.Namespaces, runtimeNamespace{Type: "user"})
+	require.Equal(t, []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}, spec.Linux.UIDMappings)
+	require.Equal(t, []IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}, {ContainerID: 65536, HostID: 300000, Size: 1000}}, spec.Linux.GIDMappings)
+
+	pulledImg.spec.Runtime.Args = []string{"sh"}
+	spec, err = pulledImg.runtimeSpec(config, "/nonexistent")
+	require.NoError(t, err)
+	require.Equal(t, []string{"sh"}, spec.Process.Args)
+
+	// Overrides replace the image's variables of the same name
+	config.Env = []string{"PATH=/image/bin", "NGINX_VERSION=1.17"}
+	pulledImg.spec.Runtime.Env = []string{"PATH=/override/bin", "FOO=bar"}
+	spec, err = pulledImg.runtimeSpec(config, "/nonexistent")
+	require.NoError(t, err)
+	require.Equal(t, []string{"PATH=/override/bin", "NGINX_VERSION=1.17", "FOO=bar"}, spec.Process.Env)
+}
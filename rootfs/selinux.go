@@ -0,0 +1,72 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// selinuxXattr holds the SELinux context of a file, and paxSELinux holds it
+// in the PAX records of a layer entry
+const (
+	selinuxXattr = "security.selinux"
+	paxSELinux   = "SCHILY.xattr." + selinuxXattr
+)
+
+// SELinux is how the extracted files are labeled, by default they get the
+// label the policy gives new files under Dest
+type SELinux struct {
+	// Context to label every file with, e.g.
+	// system_u:object_r:container_file_t:s0:c1,c2
+	Label string
+	// Label the files which have a context in the layers with it, rather
+	// than with Label
+	FromLayers bool
+}
+
+// headerLabel is the SELinux context to give the file of hdr, empty to leave
+// it alone
+func headerLabel(hdr *tar.Header, o owner) string {
+	if o.selinux.FromLayers {
+		if label, ok := hdr.PAXRecords[paxSELinux]; ok && label != "" {
+			return label
+		}
+	}
+	return o.selinux.Label
+}
+
+// relabel gives path the SELinux context of meta, if any
+func (meta dirMeta) relabel(path string) error {
+	return setLabel(path, meta.label)
+}
+
+// setLabel sets the SELinux context of path, without following symlinks
+func setLabel(path string, label string) error {
+	if label == "" {
+		return nil
+	}
+	// The kernel expects the context as a C string
+	value := []byte(label)
+	if value[len(value)-1] != 0 {
+		value = append(value, 0)
+	}
+	err := lsetxattr(path, selinuxXattr, value)
+	if perr, ok := errors.Cause(err).(*os.PathError); ok && perr.Err == syscall.ENOTSUP {
+		return errors.Errorf("can't label %s with %q, its filesystem doesn't support xattrs", path, label)
+	}
+	return errors.Wrapf(err, "labeling %s with %q", path, label)
+}
+
+// copyLabel copies the SELinux context of src, if any, to dst
+func copyLabel(src string, dst string) error {
+	label, err := lgetxattr(src, selinuxXattr)
+	if perr, ok := errors.Cause(err).(*os.PathError); ok && (perr.Err == syscall.ENODATA || perr.Err == syscall.ENOTSUP) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return setLabel(dst, string(label))
+}
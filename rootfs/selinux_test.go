@@ -0,0 +1,54 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSELinuxLabels(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("setting security xattrs needs root")
+	}
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	if err := setLabel(dest, "system_u:object_r:container_file_t:s0"); err != nil {
+		t.Skipf("can't set SELinux labels here: %s", err)
+	}
+
+	const fixed = "system_u:object_r:container_file_t:s0:c1,c2"
+	const fromLayer = "system_u:object_r:bin_t:s0"
+	layer := testLayer(t, []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555},
+		{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755, PAXRecords: map[string]string{paxSELinux: fromLayer}},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "motd"},
+	}, map[string]string{"bin/sh": "shell", "etc/motd": "hello"})
+
+	label := func(name string) string {
+		value, err := lgetxattr(filepath.Join(dest, "rootfs", name), selinuxXattr)
+		require.NoError(t, err)
+		return string(value)
+	}
+	extract := func(selinux SELinux) {
+		pulledImg := testPulledImage(t, testImage(t, layer), Spec{Dest: dest, SELinux: selinux})
+		require.NoError(t, pulledImg.extractRootfs([]v1.Layer{layer}))
+	}
+
+	extract(SELinux{Label: fixed})
+	for _, name := range []string{".", "bin", "bin/sh", "etc", "etc/motd", "etc/link"} {
+		require.Equal(t, fixed+"\x00", label(name), name)
+	}
+
+	// The settings changed, so the rootfs is extracted again
+	extract(SELinux{Label: fixed, FromLayers: true})
+	require.Equal(t, fromLayer+"\x00", label("bin/sh"))
+	require.Equal(t, fixed+"\x00", label("etc/motd"))
+}
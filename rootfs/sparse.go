@@ -0,0 +1,83 @@
+package rootfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// sparseBlock is the size of the zero runs which are left as holes rather
+// than written, the block size of most filesystems
+const sparseBlock = 4096
+
+var zeroBlock = make([]byte, sparseBlock)
+
+// writeSparse copies r to the start of the empty file f, skipping over the
+// blocks of zeros so that they are left as holes. The holes of sparse tar
+// entries are read as zeros, so this also restores them.
+func writeSparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, 32*sparseBlock)
+	var offset int64
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		data := buf[:n]
+		// Write each run of non-zero blocks at once
+		for len(data) > 0 {
+			start := 0
+			for start < len(data) && isZeroBlock(data[start:]) {
+				start += blockLen(data[start:])
+			}
+			end := start
+			for end < len(data) && !isZeroBlock(data[end:]) {
+				end += blockLen(data[end:])
+			}
+			if end > start {
+				if _, err := f.WriteAt(data[start:end], offset+int64(start)); err != nil {
+					return 0, errors.WithStack(err)
+				}
+			}
+			offset += int64(end)
+			data = data[end:]
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return 0, readErr
+		}
+	}
+	// Trailing holes aren't written, extend the file over them
+	if err := f.Truncate(offset); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return offset, nil
+}
+
+func blockLen(data []byte) int {
+	if len(data) < sparseBlock {
+		return len(data)
+	}
+	return sparseBlock
+}
+
+// isZeroBlock reports whether the first block of data is all zeros
+func isZeroBlock(data []byte) bool {
+	n := blockLen(data)
+	return bytes.Equal(data[:n], zeroBlock[:n])
+}
+
+// allocatedSize is the disk space used by the file at path, which is less
+// than its size when it has holes
+func allocatedSize(path string) int64 {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
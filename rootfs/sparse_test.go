@@ -0,0 +1,112 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Zero runs at the start, in the middle and at the end, and a partial
+	// block of zeros, which is written
+	content := make([]byte, 1<<20)
+	copy(content[64<<10:], "data")
+	copy(content[512<<10:], "more data")
+	content = append(content, make([]byte, 100)...)
+
+	path := filepath.Join(dir, "file")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	n, err := writeSparse(f, bytes.NewReader(content))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, int64(len(content)), n)
+
+	written, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, written)
+	require.True(t, allocatedSize(path) < int64(len(content))/4, "allocated %d bytes", allocatedSize(path))
+}
+
+// gnuSparseTar is a tar with an old GNU format sparse entry, as written by
+// GNU tar --sparse, of size bytes with the given fragments. archive/tar can't
+// write those, so the header of a regular entry is patched.
+func gnuSparseTar(t *testing.T, name string, size int64, fragments map[int64]string) []byte {
+	var offsets []int64
+	var data string
+	for offset := range fragments {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	require.True(t, len(offsets) <= 4, "only 4 fragments fit in the header")
+	for _, offset := range offsets {
+		data += fragments[offset]
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		Format:   tar.FormatGNU,
+	}))
+	_, err := tw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	blk := buf.Bytes()
+	octal := func(field []byte, n int64) {
+		copy(field, fmt.Sprintf("%0*o\x00", len(field)-1, n))
+	}
+	blk[156] = tar.TypeGNUSparse
+	for i, offset := range offsets {
+		octal(blk[386+i*24:398+i*24], offset)
+		octal(blk[398+i*24:410+i*24], int64(len(fragments[offset])))
+	}
+	octal(blk[483:495], size)
+	// The checksum is computed with the checksum field as spaces
+	copy(blk[148:156], "        ")
+	sum := 0
+	for _, b := range blk[:512] {
+		sum += int(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+// Test that a GNU sparse entry is extracted with its holes
+func TestExtractSparse(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	const size = 4 << 20
+	sparse := gnuSparseTar(t, "disk.img", size, map[int64]string{0: "start", 2 << 20: "middle"})
+	f, err := newFilter(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, handleFiles(tar.NewReader(bytes.NewReader(sparse)), rootfs, testOwner(), make(map[string]dirMeta), f, nil, nil))
+
+	path := filepath.Join(rootfs, "disk.img")
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, content, size)
+	require.Equal(t, "start", string(content[:5]))
+	require.Equal(t, "middle", string(content[2<<20:2<<20+6]))
+	require.Equal(t, make([]byte, 1<<20), content[1<<20:2<<20])
+	require.Equal(t, int64(size), f.stats.extractedBytes)
+	require.Equal(t, allocatedSize(path), f.stats.allocatedBytes)
+	require.True(t, f.stats.allocatedBytes < size/4)
+}
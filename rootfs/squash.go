@@ -0,0 +1,157 @@
+package rootfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// Formats for Export.Format
+const (
+	// FormatOCI writes the image to an OCI image layout directory, adding
+	// it to the layout's index if there is one
+	FormatOCI = "oci"
+	// FormatDockerArchive writes the image as a tarball docker load reads
+	FormatDockerArchive = "docker-archive"
+)
+
+// ociRefName annotates an image of an OCI layout index with its tag
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// exportImage flattens the layers into a temporary directory under Dest and
+// writes it out as a single layer image, with the config of the pulled image
+func (pulledImg *PulledImage) exportImage(layers []v1.Layer) error {
+	rootfsPath, err := ioutil.TempDir(pulledImg.spec.Dest, ".rootfs-export-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(rootfsPath)
+	if err := pulledImg.flatten(layers, rootfsPath); err != nil {
+		return err
+	}
+
+	o := pulledImg.owner()
+	if pulledImg.spec.Export.KeepHostIDs {
+		o = owner{}
+	}
+	layerPath := rootfsPath + ".tar"
+	if err := writeLayerTar(layerPath, rootfsPath, o); err != nil {
+		return err
+	}
+	defer os.Remove(layerPath)
+	layer, err := tarball.LayerFromFile(layerPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	img, err := pulledImg.squashedImage(layer, len(layers))
+	if err != nil {
+		return err
+	}
+	return pulledImg.writeImage(img)
+}
+
+// validateImageExport checks Export before an image is built for it
+func (pulledImg *PulledImage) validateImageExport() error {
+	export := pulledImg.spec.Export
+	if export.Path == "" || export.Path == "-" {
+		return errors.New("Specify a path to export the image to")
+	}
+	if export.Compression != CompressionNone {
+		return errors.New("Compression isn't supported with the image output, layers are gzipped")
+	}
+	switch export.Format {
+	case "", FormatOCI, FormatDockerArchive:
+	default:
+		return errors.Errorf("unknown image format %q", export.Format)
+	}
+	return nil
+}
+
+// writeImage writes img to Export.Path in Export.Format
+func (pulledImg *PulledImage) writeImage(img v1.Image) error {
+	export := pulledImg.spec.Export
+	log.Debugf("Exporting image to %s", export.Path)
+	switch export.Format {
+	case "", FormatOCI:
+		return writeLayout(export.Path, img, export.Tag)
+	case FormatDockerArchive:
+		tag := export.Tag
+		if tag == "" {
+			tag = pulledImg.name
+		}
+		ref, err := name.NewTag(tag, name.WeakValidation)
+		if err != nil {
+			return errors.Wrapf(err, "tagging the image %s, set Export.Tag", tag)
+		}
+		return errors.WithStack(tarball.WriteToFile(export.Path, ref, img))
+	default:
+		return errors.Errorf("unknown image format %q", export.Format)
+	}
+}
+
+// writeLayerTar writes the tree at rootfs to a tar at path, see writeTar
+func writeLayerTar(path string, rootfs string, o owner) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeTar(f, rootfs, o); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.WithStack(f.Close())
+}
+
+// squashedImage is the pulled image with layer in place of its n layers.
+// The history of the original layers is kept, as empty layers, and an
+// entry is added for layer.
+func (pulledImg *PulledImage) squashedImage(layer v1.Layer, n int) (v1.Image, error) {
+	configFile, err := pulledImg.img.ConfigFile()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cfg := configFile.DeepCopy()
+	cfg.RootFS.DiffIDs = nil
+	for i := range cfg.History {
+		cfg.History[i].EmptyLayer = true
+	}
+	img, err := mutate.ConfigFile(empty.Image, cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	img, err = mutate.Append(img, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			// Keep the image reproducible
+			Created:   cfg.Created,
+			CreatedBy: "rootfs_builder",
+			Comment:   fmt.Sprintf("flattened %d layers of %s", n, pulledImg.name),
+		},
+	})
+	return img, errors.WithStack(err)
+}
+
+// writeLayout adds img to the OCI layout at path, creating it if needed
+func writeLayout(path string, img v1.Image, tag string) error {
+	var options []layout.Option
+	if tag != "" {
+		options = append(options, layout.WithAnnotations(map[string]string{ociRefName: tag}))
+	}
+	p, err := layout.FromPath(path)
+	if os.IsNotExist(err) {
+		p, err = layout.Write(path, empty.Index)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "opening OCI layout %s", path)
+	}
+	return errors.WithStack(p.AppendImage(img, options...))
+}
@@ -0,0 +1,92 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squash")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	layers := []v1.Layer{
+		testLayer(t, []*tar.Header{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/issue", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000},
+		}, map[string]string{"etc/motd": "hello", "etc/issue": "issue"}),
+		testLayer(t, []*tar.Header{
+			{Name: "etc/.wh.motd", Typeflag: tar.TypeReg},
+		}, nil),
+	}
+	original := testImage(t, layers...)
+
+	// The flattened image has the rootfs Extract produces as its one layer
+	check := func(img v1.Image) {
+		imgLayers, err := img.Layers()
+		require.NoError(t, err)
+		require.Len(t, imgLayers, 1)
+		cfg, err := img.ConfigFile()
+		require.NoError(t, err)
+		diffID, err := imgLayers[0].DiffID()
+		require.NoError(t, err)
+		require.Equal(t, []v1.Hash{diffID}, cfg.RootFS.DiffIDs)
+		require.Len(t, cfg.History, 3)
+		require.True(t, cfg.History[0].EmptyLayer)
+		require.True(t, cfg.History[1].EmptyLayer)
+		require.False(t, cfg.History[2].EmptyLayer)
+
+		rc, err := imgLayers[0].Uncompressed()
+		require.NoError(t, err)
+		defer rc.Close()
+		tr := tar.NewReader(rc)
+		owners := make(map[string]int)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			owners[hdr.Name] = hdr.Uid
+		}
+		require.Equal(t, map[string]int{"etc/": 0, "etc/issue": 1000}, owners)
+	}
+
+	for _, format := range []string{FormatOCI, FormatDockerArchive} {
+		path := filepath.Join(dir, format)
+		pulledImg := testPulledImage(t, original, Spec{
+			Dest:   dir,
+			Output: OutputImage,
+			Export: Export{Path: path, Format: format},
+		})
+		require.NoError(t, pulledImg.exportImage(layers))
+
+		var img v1.Image
+		if format == FormatOCI {
+			index, err := layout.ImageIndexFromPath(path)
+			require.NoError(t, err)
+			manifest, err := index.IndexManifest()
+			require.NoError(t, err)
+			require.Len(t, manifest.Manifests, 1)
+			img, err = index.Image(manifest.Manifests[0].Digest)
+			require.NoError(t, err)
+		} else {
+			tag, err := name.NewTag(pulledImg.name, name.WeakValidation)
+			require.NoError(t, err)
+			img, err = tarball.ImageFromPath(path, &tag)
+			require.NoError(t, err)
+		}
+		check(img)
+	}
+}
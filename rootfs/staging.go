@@ -0,0 +1,88 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// stagingDir is the sibling of Dest/rootfs the rootfs is built in, and only
+// renamed into place once complete, so that Dest/rootfs is never half
+// extracted
+const stagingDir = ".rootfs.staging"
+
+// extractRootfs flattens the layers into Dest/rootfs, through the staging
+// directory
+func (pulledImg *PulledImage) extractRootfs(layers []v1.Layer) error {
+	dest := pulledImg.spec.Dest
+	rootfsPath := filepath.Join(dest, "rootfs")
+	stagingPath := filepath.Join(dest, stagingDir)
+
+	// Left over by a run which failed or was killed
+	if err := removeAll(stagingPath); err != nil {
+		return err
+	}
+	// The rootfs is about to change, so the old manifest no longer holds
+	manifestPath := filepath.Join(dest, ManifestFile)
+	if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	// The previous rootfs is moved to the staging directory when layers are
+	// only added on top of it, and otherwise stays in place until the swap
+	base := rootfsPath
+	if pulledImg.spec.Conflict == ConflictReplace {
+		base = ""
+	}
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	record, err := pulledImg.update(layers, stagingPath, base)
+	if err == nil {
+		// The record of a kept rootfs holds until the swap
+		err = removeProvenance(dest)
+	}
+	if err == nil {
+		err = swapRootfs(stagingPath, rootfsPath)
+	}
+	if err != nil {
+		if pulledImg.spec.KeepStaging {
+			log.Warnf("Keeping the partial rootfs in %s", stagingPath)
+		} else if cleanupErr := removeAll(stagingPath); cleanupErr != nil {
+			log.Warnf("Failed to remove %s: %s", stagingPath, cleanupErr)
+		}
+		return err
+	}
+	if err := record.write(dest); err != nil {
+		return err
+	}
+
+	if err := pulledImg.writeRuntimeConfig(rootfsPath); err != nil {
+		return err
+	}
+	if pulledImg.spec.Manifest {
+		return writeManifestFile(manifestPath, rootfsPath)
+	}
+	return nil
+}
+
+// swapRootfs puts the complete rootfs at stagingPath in place of the one at
+// rootfsPath, if any, in a single step, and removes the previous rootfs
+func swapRootfs(stagingPath string, rootfsPath string) error {
+	err := renameExchange(stagingPath, rootfsPath)
+	if os.IsNotExist(errors.Cause(err)) {
+		return errors.WithStack(os.Rename(stagingPath, rootfsPath))
+	}
+	if err != nil {
+		return err
+	}
+	// The previous rootfs is now at stagingPath
+	if err := removeAll(stagingPath); err != nil {
+		log.Warnf("Failed to remove the previous rootfs in %s: %s", stagingPath, err)
+	}
+	return nil
+}
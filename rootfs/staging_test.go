@@ -0,0 +1,71 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a failed extraction never leaves a partial Dest/rootfs
+func TestStagingRollback(t *testing.T) {
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	a, b := fileLayer(t, "a"), fileLayer(t, "b")
+	// Fails after extracting c, as the link target doesn't exist
+	broken := testLayer(t, []*tar.Header{
+		{Name: "c", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "missing"},
+	}, map[string]string{"c": "c"})
+	extract := func(spec Spec, layers ...v1.Layer) error {
+		spec.Dest = dest
+		pulledImg := testPulledImage(t, testImage(t, layers...), spec)
+		return pulledImg.extractRootfs(layers)
+	}
+	exists := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(dest, name))
+		return err == nil
+	}
+
+	require.NoError(t, extract(Spec{}, a))
+	require.True(t, exists("rootfs/a"))
+	require.False(t, exists(stagingDir))
+
+	// The previous rootfs is kept until the swap when it isn't updated
+	require.Error(t, extract(Spec{}, b, broken))
+	require.True(t, exists("rootfs/a") && exists(ProvenanceFile))
+	require.False(t, exists("rootfs/b") || exists(stagingDir))
+	require.Error(t, extract(Spec{Conflict: ConflictReplace}, a, broken))
+	require.True(t, exists("rootfs/a") && exists(ProvenanceFile))
+	require.False(t, exists("rootfs/c") || exists(stagingDir))
+
+	// When layers are added on top, it is moved to the staging directory
+	// to be updated there
+	require.Error(t, extract(Spec{}, a, broken))
+	require.False(t, exists("rootfs") || exists(stagingDir) || exists(ProvenanceFile))
+
+	require.NoError(t, extract(Spec{}, a))
+	require.NoError(t, extract(Spec{}, a, b))
+	require.True(t, exists("rootfs/a") && exists("rootfs/b"))
+	record, err := readProvenance(dest)
+	require.NoError(t, err)
+	require.Len(t, record.Layers, 2)
+
+	// The partial rootfs can be kept for debugging
+	require.Error(t, extract(Spec{KeepStaging: true}, a, b, broken))
+	require.True(t, exists(stagingDir+"/c"))
+	require.False(t, exists("rootfs/c"))
+	require.NoError(t, extract(Spec{}, a, b))
+	require.False(t, exists(stagingDir))
+
+	// The new rootfs is exchanged with the previous one
+	require.NoError(t, extract(Spec{Conflict: ConflictReplace}, b))
+	require.True(t, exists("rootfs/b"))
+	require.False(t, exists("rootfs/a") || exists(stagingDir))
+}
@@ -0,0 +1,258 @@
+package rootfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/pkg/errors"
+)
+
+// ficlone is the FICLONE ioctl, which makes a file share the blocks of
+// another on filesystems with reflinks, e.g. btrfs and xfs
+const ficlone = 0x40049409
+
+// contentStore keeps the content of regular files by sha256, so that the
+// rootfs trees sharing a store share their files' blocks, see Spec.Store.
+//
+// The store holds objects/<sha256>, the content of a file, and, with
+// hardlinks, links/<key>, a file with that content and the metadata hashed
+// into key, which files with the same metadata are hard linked to.
+type contentStore struct {
+	path string
+	// Hard link files with the same content and metadata
+	hardlinks bool
+	// Cleared once reflinks turn out not to be supported
+	reflinks bool
+	// How many files were placed with each method
+	reflinked, linked, copied int
+	// Space used on the store's filesystem when it was opened
+	usedBefore uint64
+}
+
+// newContentStore opens the store at path, creating it if needed
+func newContentStore(path string, hardlinks bool) (*contentStore, error) {
+	for _, dir := range []string{"objects", "links", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0755); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	used, err := diskUsage(path)
+	if err != nil {
+		return nil, err
+	}
+	return &contentStore{path: path, hardlinks: hardlinks, reflinks: true, usedBefore: used}, nil
+}
+
+// openStore opens Spec.Store, nil when it isn't set or wouldn't be used.
+// Without reflinks to Dest, files would be copied from the store and take
+// twice the space, so the store is only used with hardlinks then.
+func (pulledImg *PulledImage) openStore() (*contentStore, error) {
+	if pulledImg.spec.Store == "" {
+		return nil, nil
+	}
+	s, err := newContentStore(pulledImg.spec.Store, pulledImg.spec.StoreHardlinks)
+	if err != nil {
+		return nil, err
+	}
+	s.reflinks = s.canReflink(pulledImg.spec.Dest)
+	if !s.reflinks && !s.hardlinks {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// contentStore opens Spec.Store like openStore, warning when files won't be
+// shared through it
+func (pulledImg *PulledImage) contentStore() (*contentStore, error) {
+	s, err := pulledImg.openStore()
+	switch {
+	case err != nil:
+		return nil, err
+	case s == nil && pulledImg.spec.Store != "":
+		log.Warnf("Not using the store %s, which can't be reflinked to %s, set StoreHardlinks to share files", pulledImg.spec.Store, pulledImg.spec.Dest)
+	case s != nil && !s.reflinks:
+		log.Warnf("The store %s can't be reflinked to %s, files are only shared when hard linked", s.path, pulledImg.spec.Dest)
+	}
+	return s, nil
+}
+
+// canReflink reports whether the store's files can be reflinked to dir
+func (s *contentStore) canReflink(dir string) bool {
+	src, err := ioutil.TempFile(filepath.Join(s.path, "tmp"), "probe-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, ".reflink-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	if _, err := src.Write([]byte{0}); err != nil {
+		return false
+	}
+	errno := reflink(dst, src)
+	if errno != 0 {
+		log.Debugf("Reflinks aren't supported from %s to %s: %s", s.path, dir, errno)
+	}
+	return errno == 0
+}
+
+// extract creates the regular file at path with the content of r, through
+// the store when there is one. When the file could be hard linked to one with
+// the same content and metadata, linked is set, and the metadata mustn't be
+// applied. Otherwise, once it is, keep should be called with linkPath.
+func (s *contentStore) extract(r io.Reader, path string, meta dirMeta) (linkPath string, linked bool, err error) {
+	if s == nil {
+		f, err := os.Create(path)
+		if err != nil {
+			return "", false, err
+		}
+		if _, err := writeSparse(f, r); err != nil {
+			f.Close()
+			return "", false, err
+		}
+		return "", false, f.Close()
+	}
+	digest, err := s.add(r)
+	if err != nil {
+		return "", false, err
+	}
+	linkPath = s.linkPath(digest, meta)
+	if s.link(linkPath, path) {
+		return "", true, nil
+	}
+	return linkPath, false, s.place(digest, path)
+}
+
+// add reads r into the store and returns its sha256
+func (s *contentStore) add(r io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.path, "tmp"), "object-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := writeSparse(tmp, io.TeeReader(r, h)); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	object := s.object(digest)
+	if _, err := os.Lstat(object); err == nil {
+		return digest, nil
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return digest, errors.WithStack(os.Rename(tmp.Name(), object))
+}
+
+func (s *contentStore) object(digest string) string {
+	return filepath.Join(s.path, "objects", digest)
+}
+
+// linkPath is where the file with the given content and metadata is kept for
+// hard linking, empty without hardlinks
+func (s *contentStore) linkPath(digest string, meta dirMeta) string {
+	if !s.hardlinks {
+		return ""
+	}
+	key := fmt.Sprintf("%s %o %d %d %d %v %q", digest, meta.mode, meta.uid, meta.gid, meta.mtime.UnixNano(), meta.rootless, meta.label)
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.path, "links", hex.EncodeToString(sum[:]))
+}
+
+// link hard links the file kept at linkPath to path, and reports whether it
+// could. The file then already has its metadata.
+func (s *contentStore) link(linkPath string, path string) bool {
+	if linkPath == "" || os.Link(linkPath, path) != nil {
+		return false
+	}
+	s.linked++
+	return true
+}
+
+// keep records path, whose metadata is now applied, at linkPath for the next
+// files to be hard linked to it
+func (s *contentStore) keep(path string, linkPath string) {
+	if s == nil || linkPath == "" {
+		return
+	}
+	if err := os.Link(path, linkPath); err != nil && !os.IsExist(err) {
+		log.Debugf("Not keeping %s in the store: %s", path, err)
+	}
+}
+
+// place creates path with the content of the object, sharing its blocks if
+// possible
+func (s *contentStore) place(digest string, path string) error {
+	src, err := os.Open(s.object(digest))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if s.reflinks {
+		errno := reflink(dst, src)
+		if errno == 0 {
+			s.reflinked++
+			return dst.Close()
+		}
+		// Any other error is specific to this file
+		if errno == syscall.EOPNOTSUPP || errno == syscall.ENOTTY || errno == syscall.EINVAL || errno == syscall.EXDEV {
+			log.Debugf("Reflinks aren't supported from %s: %s", s.path, errno)
+			s.reflinks = false
+		}
+	}
+	if _, err := writeSparse(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	s.copied++
+	return dst.Close()
+}
+
+// reflink makes dst share the blocks of src
+func reflink(dst *os.File, src *os.File) syscall.Errno {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	return errno
+}
+
+// report logs how the files were placed, and the disk usage before and after
+func (s *contentStore) report() {
+	if s == nil {
+		return
+	}
+	log.Infof("Placed files from %s: %d reflinked, %d hard linked, %d copied", s.path, s.reflinked, s.linked, s.copied)
+	used, err := diskUsage(s.path)
+	if err != nil {
+		log.Warnf("%s", err)
+		return
+	}
+	log.Infof("Disk usage of %s went from %d to %d bytes", s.path, s.usedBefore, used)
+}
+
+// diskUsage is the space used on the filesystem holding path
+func diskUsage(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, errors.Wrapf(err, "statfs %s", path)
+	}
+	return (st.Blocks - st.Bfree) * uint64(st.Bsize), nil
+}
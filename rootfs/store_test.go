@@ -0,0 +1,106 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hdrs := func(mode int64) []*tar.Header {
+		return []*tar.Header{
+			{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: mode},
+		}
+	}
+	contents := map[string]string{"bin/sh": "shell", "etc/motd": "hello"}
+	extract := func(rootfs string, hardlinks bool, mode int64) *contentStore {
+		s, err := newContentStore(filepath.Join(dir, "store"), hardlinks)
+		require.NoError(t, err)
+		rootfs = filepath.Join(dir, rootfs)
+		require.NoError(t, os.Mkdir(rootfs, 0755))
+		require.NoError(t, handleFiles(buildTar(t, hdrs(mode), contents), rootfs, testOwner(), make(map[string]dirMeta), nil, s, nil))
+		return s
+	}
+	same := func(a string, b string) bool {
+		fa, err := os.Stat(filepath.Join(dir, a))
+		require.NoError(t, err)
+		fb, err := os.Stat(filepath.Join(dir, b))
+		require.NoError(t, err)
+		return os.SameFile(fa, fb)
+	}
+
+	// Without hardlinks, files are reflinked or copied
+	s := extract("a", false, 0644)
+	require.Equal(t, 2, s.reflinked+s.copied)
+	objects, err := ioutil.ReadDir(filepath.Join(dir, "store", "objects"))
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a", "etc", "motd"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	// With hardlinks, the first tree's files are kept for the next ones
+	s = extract("b", true, 0644)
+	require.Equal(t, 0, s.linked)
+	s = extract("c", true, 0644)
+	require.Equal(t, 2, s.linked)
+	require.True(t, same("b/bin/sh", "c/bin/sh"))
+	require.True(t, same("b/etc/motd", "c/etc/motd"))
+	require.False(t, same("a/etc/motd", "b/etc/motd"))
+
+	// Files with other metadata aren't linked to them
+	s = extract("d", true, 0600)
+	require.Equal(t, 1, s.linked)
+	require.True(t, same("b/bin/sh", "d/bin/sh"))
+	require.False(t, same("b/etc/motd", "d/etc/motd"))
+	fi, err := os.Stat(filepath.Join(dir, "d", "etc", "motd"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode())
+
+	// Links from the store don't count in the manifest
+	entries, err := manifestEntries(filepath.Join(dir, "c"))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.keywords, "nlink", entry.path)
+	}
+}
+
+// Test that a store which would only double the space used isn't used
+func TestContentStoreWithoutReflinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pulledImg := &PulledImage{spec: Spec{Dest: dir, Store: filepath.Join(dir, "store")}}
+	s, err := pulledImg.contentStore()
+	require.NoError(t, err)
+	probe, err := newContentStore(pulledImg.spec.Store, false)
+	require.NoError(t, err)
+	if probe.canReflink(dir) {
+		require.NotNil(t, s)
+		require.True(t, s.reflinks)
+	} else {
+		require.Nil(t, s)
+	}
+
+	// Hard links still share files
+	pulledImg.spec.StoreHardlinks = true
+	s, err = pulledImg.contentStore()
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	require.True(t, s.hardlinks)
+
+	// The probes are cleaned up
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "store", "tmp"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,150 @@
+package rootfs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Flags for the *at syscalls, which the syscall package doesn't export
+const (
+	// atFdcwd resolves relative paths against the working directory
+	atFdcwd = -0x64
+	// atSymlinkNofollow operates on a symlink rather than its target
+	atSymlinkNofollow = 0x100
+	// utimeOmit leaves a timestamp unchanged
+	utimeOmit = (1 << 30) - 2
+	// renameExchangeFlag has renameat2 swap the two paths
+	renameExchangeFlag = 0x2
+	// sysRenameat2 is the number of renameat2 on amd64
+	sysRenameat2 = 316
+)
+
+// lchtimes is os.Chtimes without following symlinks. Zero times are left
+// unchanged.
+func lchtimes(path string, atime time.Time, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := []syscall.Timespec{timespec(atime), timespec(mtime)}
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return errors.WithStack(&os.PathError{Op: "lchtimes", Path: path, Err: errno})
+	}
+	return nil
+}
+
+// renameExchange swaps the files at oldpath and newpath, which must both
+// exist, atomically
+func renameExchange(oldpath string, newpath string) error {
+	oldp, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(sysRenameat2, uintptr(dirfd), uintptr(unsafe.Pointer(oldp)),
+		uintptr(dirfd), uintptr(unsafe.Pointer(newp)), renameExchangeFlag, 0)
+	if errno != 0 {
+		return errors.WithStack(&os.LinkError{Op: "renameat2", Old: oldpath, New: newpath, Err: errno})
+	}
+	return nil
+}
+
+func timespec(t time.Time) syscall.Timespec {
+	if t.IsZero() {
+		return syscall.Timespec{Nsec: utimeOmit}
+	}
+	return syscall.NsecToTimespec(t.UnixNano())
+}
+
+func timespecTime(ts syscall.Timespec) time.Time {
+	return time.Unix(ts.Sec, ts.Nsec)
+}
+
+// llistxattr lists the xattrs of path, without following symlinks
+func llistxattr(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	size, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), 0, 0)
+	if errno == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if errno != 0 {
+		return nil, errors.WithStack(&os.PathError{Op: "llistxattr", Path: path, Err: errno})
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if errno != 0 {
+		return nil, errors.WithStack(&os.PathError{Op: "llistxattr", Path: path, Err: errno})
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// lgetxattr reads an xattr of path, without following symlinks
+func lgetxattr(path string, name string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(n)), 0, 0, 0, 0)
+	if errno != 0 {
+		return nil, errors.WithStack(&os.PathError{Op: "lgetxattr", Path: path, Err: errno})
+	}
+	buf := make([]byte, size+1)
+	size, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	if errno != 0 {
+		return nil, errors.WithStack(&os.PathError{Op: "lgetxattr", Path: path, Err: errno})
+	}
+	return buf[:size], nil
+}
+
+// lsetxattr sets an xattr of path, without following symlinks
+func lsetxattr(path string, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(n)), uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errors.WithStack(&os.PathError{Op: "lsetxattr", Path: path, Err: errno})
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ForAllSecure/rootfs_builder/log"
+	"github.com/pkg/errors"
+)
+
+// Whiteout file names, as defined by the OCI image spec
+// https://github.com/opencontainers/image-spec/blob/master/layer.md#whiteouts
+const (
+	// whiteoutPrefix hides the lower layer path named by the rest of the name
+	whiteoutPrefix = ".wh."
+	// whiteoutMetaPrefix is reserved for aufs metadata, e.g. .wh..wh.plnk
+	whiteoutMetaPrefix = whiteoutPrefix + whiteoutPrefix
+	// whiteoutOpaqueDir hides all lower layer children of its directory
+	whiteoutOpaqueDir = whiteoutMetaPrefix + ".opq"
+)
+
+// isWhiteout reports whether base is a whiteout or an opaque directory marker
+func isWhiteout(base string) bool {
+	if base == whiteoutOpaqueDir {
+		return true
+	}
+	return strings.HasPrefix(base, whiteoutPrefix) && !strings.HasPrefix(base, whiteoutMetaPrefix)
+}
+
+// isWhiteoutMeta reports whether name is, or is under, aufs metadata, which
+// is neither a whiteout nor part of the rootfs
+func isWhiteoutMeta(name string) bool {
+	for _, part := range strings.Split(filepath.Clean(name), string(os.PathSeparator)) {
+		if part != whiteoutOpaqueDir && strings.HasPrefix(part, whiteoutMetaPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// whiteout removes the lower layer paths hidden by a whiteout entry. Paths
+// added by the current layer are never removed, as whiteouts only apply to
+// lower layers.
+func whiteout(rootfs string, hdr *tar.Header, added map[string]bool, dirs map[string]dirMeta) error {
+	// Paths relative to the rootfs, as recorded in added
+	name := filepath.Join("/", hdr.Name)
+	base := filepath.Base(name)
+	dir := filepath.Dir(name)
+
+	// Opaque directory, hide the lower layer contents of dir but keep dir
+	if base == whiteoutOpaqueDir {
+		if err := removeLower(rootfs, dir, added, dirs); err != nil {
+			return errors.Wrapf(err, "applying opaque whiteout %s", hdr.Name)
+		}
+		return nil
+	}
+
+	target := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	// A whiteout with an empty name would hide its own directory
+	if target == dir {
+		log.Warnf("Ignoring invalid whiteout %s", hdr.Name)
+		return nil
+	}
+	if added[target] {
+		return nil
+	}
+	if err := removePath(rootfs, target, dirs); err != nil {
+		return errors.Wrapf(err, "removing whiteout %s", hdr.Name)
+	}
+	return nil
+}
+
+// removeLower removes the children of dir which weren't added by the current
+// layer. Directories added by the current layer may still have lower layer
+// children, so they are walked as well.
+func removeLower(rootfs string, dir string, added map[string]bool, dirs map[string]dirMeta) error {
+	dirPath, err := securePath(rootfs, dir)
+	if err != nil {
+		return err
+	}
+	// Nothing to hide, and a symlink isn't followed
+	if fi, err := os.Lstat(dirPath); err != nil || !fi.IsDir() {
+		return nil
+	}
+	children, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		path := filepath.Join(dir, child.Name())
+		if !added[path] {
+			if err := removePath(rootfs, path, dirs); err != nil {
+				return err
+			}
+			continue
+		}
+		if child.IsDir() {
+			if err := removeLower(rootfs, path, added, dirs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removePath removes path, relative to the rootfs, along with the metadata
+// recorded for any directory under it
+func removePath(rootfs string, path string, dirs map[string]dirMeta) error {
+	path, err := securePath(rootfs, path)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	forgetDirs(dirs, path)
+	return nil
+}
+
+// forgetDirs drops the metadata recorded for path and the directories under
+// it
+func forgetDirs(dirs map[string]dirMeta, path string) {
+	for dir := range dirs {
+		if dir == path || strings.HasPrefix(dir, path+string(os.PathSeparator)) {
+			delete(dirs, dir)
+		}
+	}
+}
+
+// markAdded records that path and its parents are part of the current layer
+func markAdded(added map[string]bool, path string) {
+	for ; path != "/"; path = filepath.Dir(path) {
+		if added[path] {
+			return
+		}
+		added[path] = true
+	}
+}
@@ -0,0 +1,255 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// layer is a hand-built layer for the whiteout conformance tests. Entries
+// ending in / are directories, entries with content are regular files and
+// everything else is an empty regular file.
+type layer struct {
+	entries  []string
+	contents map[string]string
+}
+
+func (l layer) reader(t *testing.T) *tar.Reader {
+	var hdrs []*tar.Header
+	for _, name := range l.entries {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+		hdrs = append(hdrs, hdr)
+	}
+	return buildTar(t, hdrs, l.contents)
+}
+
+// tree lists the rootfs, mapping each path to its content, or "/" for a
+// directory
+func tree(t *testing.T, rootfs string) map[string]string {
+	result := make(map[string]string)
+	err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == rootfs {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			result[rel] = "/"
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		result[rel] = string(data)
+		return err
+	})
+	require.NoError(t, err)
+	return result
+}
+
+func TestWhiteoutConformance(t *testing.T) {
+	tests := []struct {
+		name     string
+		layers   []layer
+		expected map[string]string
+	}{
+		{
+			name: "whiteout file",
+			layers: []layer{
+				{entries: []string{"a/", "a/b", "a/c"}},
+				{entries: []string{"a/.wh.b"}},
+			},
+			expected: map[string]string{"a": "/", "a/c": ""},
+		},
+		{
+			name: "whiteout directory",
+			layers: []layer{
+				{entries: []string{"a/", "a/b/", "a/b/c", "a/b/d/", "a/b/d/e"}},
+				{entries: []string{"a/.wh.b"}},
+			},
+			expected: map[string]string{"a": "/"},
+		},
+		{
+			name: "whiteout name is matched exactly",
+			layers: []layer{
+				{entries: []string{"a/", "a/b", "a/bb", "b", "a/c/", "a/c/b"}},
+				{entries: []string{"a/.wh.b"}},
+			},
+			expected: map[string]string{"a": "/", "a/bb": "", "b": "", "a/c": "/", "a/c/b": ""},
+		},
+		{
+			name: "whiteout of missing path",
+			layers: []layer{
+				{entries: []string{"a/"}},
+				{entries: []string{"a/.wh.b", "c/.wh.d"}},
+			},
+			expected: map[string]string{"a": "/"},
+		},
+		{
+			name: "whiteout does not affect its own layer",
+			layers: []layer{
+				{entries: []string{"a/", "a/b", "a/c"}, contents: map[string]string{"a/b": "old"}},
+				{entries: []string{"a/b", "a/.wh.b", "a/.wh.c"}, contents: map[string]string{"a/b": "new"}},
+			},
+			expected: map[string]string{"a": "/", "a/b": "new"},
+		},
+		{
+			name: "whiteout before recreating",
+			layers: []layer{
+				{entries: []string{"a/", "a/b/", "a/b/old"}},
+				{entries: []string{"a/.wh.b", "a/b/", "a/b/new"}},
+			},
+			expected: map[string]string{"a": "/", "a/b": "/", "a/b/new": ""},
+		},
+		{
+			name: "whiteout in a later layer than the file",
+			layers: []layer{
+				{entries: []string{"a", "b"}},
+				{entries: []string{"c"}},
+				{entries: []string{".wh.a"}},
+			},
+			expected: map[string]string{"b": "", "c": ""},
+		},
+		{
+			name: "whiteout cannot escape the rootfs",
+			layers: []layer{
+				{entries: []string{"a"}},
+				{entries: []string{"../../.wh.a"}},
+			},
+			expected: map[string]string{},
+		},
+		{
+			name: "empty whiteout name is ignored",
+			layers: []layer{
+				{entries: []string{"a/", "a/b"}},
+				{entries: []string{"a/.wh."}},
+			},
+			expected: map[string]string{"a": "/", "a/b": ""},
+		},
+		{
+			name: "opaque directory",
+			layers: []layer{
+				{entries: []string{"a/", "a/b", "a/c/", "a/c/d", "e"}},
+				{entries: []string{"a/", "a/.wh..wh..opq"}},
+			},
+			expected: map[string]string{"a": "/", "e": ""},
+		},
+		{
+			name: "opaque directory keeps same layer children",
+			layers: []layer{
+				{entries: []string{"a/", "a/b", "a/c"}, contents: map[string]string{"a/b": "old"}},
+				{entries: []string{"a/", "a/b", "a/.wh..wh..opq", "a/d"}, contents: map[string]string{"a/b": "new"}},
+			},
+			expected: map[string]string{"a": "/", "a/b": "new", "a/d": ""},
+		},
+		{
+			name: "opaque directory hides lower children of same layer directories",
+			layers: []layer{
+				{entries: []string{"a/", "a/b/", "a/b/c", "a/b/d/", "a/b/d/e"}},
+				{entries: []string{"a/b/f", "a/.wh..wh..opq"}},
+			},
+			expected: map[string]string{"a": "/", "a/b": "/", "a/b/f": ""},
+		},
+		{
+			name: "opaque directory without a lower directory",
+			layers: []layer{
+				{entries: []string{"b"}},
+				{entries: []string{"a/", "a/.wh..wh..opq", "a/c"}},
+			},
+			expected: map[string]string{"a": "/", "a/c": "", "b": ""},
+		},
+		{
+			name: "opaque marker is matched exactly",
+			layers: []layer{
+				{entries: []string{"a/", "a/b"}},
+				{entries: []string{"a/.wh..wh..opqx", "a/.wh..wh.plnk/", "a/.wh..wh.plnk/123"}},
+			},
+			expected: map[string]string{"a": "/", "a/b": ""},
+		},
+		{
+			name: "file replaces directory",
+			layers: []layer{
+				{entries: []string{"a/", "a/b"}},
+				{entries: []string{"a"}, contents: map[string]string{"a": "file"}},
+			},
+			expected: map[string]string{"a": "file"},
+		},
+		{
+			name: "directory replaces file",
+			layers: []layer{
+				{entries: []string{"a"}},
+				{entries: []string{"a/", "a/b"}},
+			},
+			expected: map[string]string{"a": "/", "a/b": ""},
+		},
+		{
+			name: "directories merge",
+			layers: []layer{
+				{entries: []string{"a/", "a/b"}},
+				{entries: []string{"a/", "a/c"}},
+			},
+			expected: map[string]string{"a": "/", "a/b": "", "a/c": ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "whiteout")
+			require.NoError(t, err)
+			defer os.RemoveAll(parent)
+			rootfs := filepath.Join(parent, "rootfs")
+			require.NoError(t, os.Mkdir(rootfs, 0755))
+
+			dirs := make(map[string]dirMeta)
+			for _, l := range test.layers {
+				require.NoError(t, handleFiles(l.reader(t), rootfs, testOwner(), dirs, nil, nil, nil))
+			}
+			require.NoError(t, setDirMetadata(dirs))
+			require.Equal(t, test.expected, tree(t, rootfs))
+		})
+	}
+}
+
+// Test that an opaque directory keeps its own metadata, and that a whited
+// out directory doesn't leave its metadata behind
+func TestWhiteoutDirMetadata(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootfs)
+
+	dirs := make(map[string]dirMeta)
+	lower := buildTar(t, []*tar.Header{
+		{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0710},
+		{Name: "opaque/a", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "gone/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "gone/sub/", Typeflag: tar.TypeDir, Mode: 0700},
+	}, nil)
+	require.NoError(t, handleFiles(lower, rootfs, testOwner(), dirs, nil, nil, nil))
+
+	upper := buildTar(t, []*tar.Header{
+		{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: ".wh.gone", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "gone/sub/file", Typeflag: tar.TypeReg, Mode: 0644},
+	}, nil)
+	require.NoError(t, handleFiles(upper, rootfs, testOwner(), dirs, nil, nil, nil))
+	require.NoError(t, setDirMetadata(dirs))
+
+	fi, err := os.Stat(filepath.Join(rootfs, "opaque"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0710), fi.Mode().Perm())
+	_, err = os.Stat(filepath.Join(rootfs, "opaque/a"))
+	require.True(t, os.IsNotExist(err))
+
+	// Implicitly recreated, so it doesn't inherit the lower layer's mode
+	fi, err = os.Stat(filepath.Join(rootfs, "gone/sub"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+}
@@ -1,6 +1,6 @@
 #!/bin/bash
 #
-# Pull alpine:3.10, extract the rootfs, and verify its hash
+# Pull alpine:3.10, extract the rootfs, and verify its hash and manifest
 
 set -e
 set -x
@@ -19,13 +19,19 @@ rm -rf $test_dir
 go run main.go test/alpine.json
 
 # check config hash
-config_md5=`md5sum $test_dir/config.json | head -n1 | awk '{print $1;}'`
+config_md5=`md5sum $test_dir/image_config.json | head -n1 | awk '{print $1;}'`
 correct_config_md5="a7c6eead06dc2a2535d165d2db4d51f5"
 if [ "$config_md5" != "$correct_config_md5" ]; then
     echo "configs don't match"
     exit 1
 fi
 
+# check that config.json is a runtime config for runc
+if ! grep -q '"ociVersion"' $test_dir/config.json; then
+    echo "config.json is not a runtime config"
+    exit 1
+fi
+
 # check rootfs hash
 rootfs_md5=`find $test_dir/rootfs -type f -exec md5sum {} \; | sort -k 2 | md5sum | head -n1 | awk '{print $1;}'`
 correct_rootfs_md5="31ae55aacfa90c87e313a196617c5fe3"
@@ -35,6 +41,16 @@ if [ "$rootfs_md5" != "$correct_rootfs_md5" ]; then
     exit 1
 fi
 
+# check the rootfs against its manifest
+go run main.go verify $test_dir/rootfs.mtree $test_dir/rootfs
+
+# check that tampering is detected
+echo "tampered" >> $test_dir/rootfs/etc/motd
+if go run main.go verify $test_dir/rootfs.mtree $test_dir/rootfs; then
+    echo "tampering wasn't detected"
+    exit 1
+fi
+
 # tear down
 rm -rf $test_dir
 
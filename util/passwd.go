@@ -0,0 +1,106 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// User is an entry of an /etc/passwd file
+type User struct {
+	Name  string
+	Uid   int
+	Gid   int
+	Home  string
+	Shell string
+}
+
+// Group is an entry of an /etc/group file
+type Group struct {
+	Name    string
+	Gid     int
+	Members []string
+}
+
+// ParsePasswdFile reads the users from an /etc/passwd file. A missing file
+// has no users.
+func ParsePasswdFile(path string) ([]User, error) {
+	var users []User
+	err := parseColonFile(path, 7, func(parts []string) error {
+		uid, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return err
+		}
+		users = append(users, User{
+			Name:  parts[0],
+			Uid:   uid,
+			Gid:   gid,
+			Home:  parts[5],
+			Shell: parts[6],
+		})
+		return nil
+	})
+	return users, err
+}
+
+// ParseGroupFile reads the groups from an /etc/group file. A missing file
+// has no groups.
+func ParseGroupFile(path string) ([]Group, error) {
+	var groups []Group
+	err := parseColonFile(path, 4, func(parts []string) error {
+		gid, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return err
+		}
+		var members []string
+		if parts[3] != "" {
+			members = strings.Split(parts[3], ",")
+		}
+		groups = append(groups, Group{Name: parts[0], Gid: gid, Members: members})
+		return nil
+	})
+	return groups, err
+}
+
+// parseColonFile calls parse on each entry of a colon separated file such as
+// /etc/passwd. Comments, blank lines and NIS entries are skipped. An entry
+// without the given number of fields, or which parse fails on, is an error.
+func parseColonFile(path string, fields int, parse func([]string) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.WithStack(err)
+		}
+		text := strings.TrimSpace(line)
+		if text != "" && !strings.HasPrefix(text, "#") && !strings.HasPrefix(text, "+") && !strings.HasPrefix(text, "-") {
+			parts := strings.Split(text, ":")
+			if len(parts) != fields {
+				return errors.Errorf("%s:%d: invalid entry, %d fields instead of %d", path, n, len(parts), fields)
+			}
+			if err := parse(parts); err != nil {
+				return errors.Wrapf(err, "%s:%d: invalid entry", path, n)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
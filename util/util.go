@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
@@ -41,56 +42,68 @@ func UnmarshalFile(filepath string, dst interface{}) error {
 	return nil
 }
 
-// GetSubid looks up the subuid and subgid for the given user
-func GetSubid(userObj *user.User) (int, int, error) {
-	subuidFile, err := os.Open("/etc/subuid")
+// IDRange is a range of subordinate IDs from /etc/subuid or /etc/subgid
+type IDRange struct {
+	Start int
+	Size  int
+}
+
+// GetSubidRanges looks up all the subuid and subgid ranges of the given user,
+// in the order of /etc/subuid and /etc/subgid
+func GetSubidRanges(userObj *user.User) ([]IDRange, []IDRange, error) {
+	subuids, err := readSubidRanges("/etc/subuid", userObj.Username, userObj.Uid)
 	if err != nil {
-		return -1, -1, err
+		return nil, nil, err
 	}
-	defer subuidFile.Close()
-	subuid, err := parseSubidFile(subuidFile, userObj.Username, userObj.Uid)
+	subgids, err := readSubidRanges("/etc/subgid", userObj.Username, userObj.Gid)
 	if err != nil {
-		return -1, -1, err
+		return nil, nil, err
 	}
+	return subuids, subgids, nil
+}
 
-	subgidFile, err := os.Open("/etc/subgid")
+func readSubidRanges(path string, name string, id string) ([]IDRange, error) {
+	subidFile, err := os.Open(path)
 	if err != nil {
-		return -1, -1, err
+		return nil, err
 	}
-	defer subgidFile.Close()
-	subgid, err := parseSubidFile(subgidFile, userObj.Username, userObj.Gid)
+	defer subidFile.Close()
+	ranges, err := parseSubidRanges(subidFile, name, id)
 	if err != nil {
-		return -1, -1, err
+		return nil, errors.Wrapf(err, "reading %s", path)
 	}
-
-	return subuid, subgid, nil
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no matching sub[gu]id found for user %s", name)
+	}
+	return ranges, nil
 }
 
-func parseSubidFile(subidFile *os.File, name string, id string) (int, error) {
-	scanner := bufio.NewScanner(subidFile)
+func parseSubidRanges(r io.Reader, name string, id string) ([]IDRange, error) {
+	var ranges []IDRange
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		err := scanner.Err()
-		if err != nil {
-			return -1, err
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
 		}
-
-		parts := strings.Split(scanner.Text(), ":")
+		parts := strings.Split(text, ":")
 		if len(parts) != 3 {
-			return -1, fmt.Errorf("invalid /etc/sub[gu]id file")
+			return nil, fmt.Errorf("invalid /etc/sub[gu]id file")
+		}
+		if parts[0] != name && parts[0] != id {
+			continue
+		}
+		start, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		size, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, errors.WithStack(err)
 		}
-		if parts[0] == name || parts[0] == id {
-			size, err := strconv.Atoi(parts[2])
-			if err != nil {
-				return -1, err
-			}
-			if size >= MapSize {
-				subid, err := strconv.Atoi(parts[1])
-				if err != nil {
-					return -1, err
-				}
-				return subid, nil
-			}
+		if size > 0 {
+			ranges = append(ranges, IDRange{Start: start, Size: size})
 		}
 	}
-	return -1, fmt.Errorf("no matching sub[gu]id found for user %s", name)
+	return ranges, errors.WithStack(scanner.Err())
 }
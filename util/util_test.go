@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -38,3 +39,52 @@ func TestUnmarshalFileEmpty(t *testing.T) {
 	err := UnmarshalFile("foo.json", test)
 	require.Error(t, err)
 }
+
+func TestParseSubidRanges(t *testing.T) {
+	file := "# comment\n" +
+		"other:100000:65536\n" +
+		"user:165536:1000\n" +
+		"\n" +
+		"1000:300000:65536\n" +
+		"user:400000:0\n"
+	ranges, err := parseSubidRanges(strings.NewReader(file), "user", "1000")
+	require.NoError(t, err)
+	require.Equal(t, []IDRange{{Start: 165536, Size: 1000}, {Start: 300000, Size: 65536}}, ranges)
+
+	ranges, err = parseSubidRanges(strings.NewReader(file), "nobody", "65534")
+	require.NoError(t, err)
+	require.Empty(t, ranges)
+
+	_, err = parseSubidRanges(strings.NewReader("user:1\n"), "user", "1000")
+	require.Error(t, err)
+}
+
+func TestParsePasswdFile(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "passwd")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	write := func(content string) {
+		require.NoError(t, ioutil.WriteFile(tmpfile.Name(), []byte(content), 0644))
+	}
+
+	write("root:x:0:0:root:/root:/bin/sh\n# comment\n+nis\n\nnginx:x:101:101::/:/sbin/nologin\n")
+	users, err := ParsePasswdFile(tmpfile.Name())
+	require.NoError(t, err)
+	require.Equal(t, []User{
+		{Name: "root", Uid: 0, Gid: 0, Home: "/root", Shell: "/bin/sh"},
+		{Name: "nginx", Uid: 101, Gid: 101, Home: "/", Shell: "/sbin/nologin"},
+	}, users)
+
+	// Malformed entries aren't skipped
+	write("root:x:0:0:root:/root:/bin/sh\nnginx:x:nginx:101::/:/sbin/nologin\n")
+	_, err = ParsePasswdFile(tmpfile.Name())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ":2:")
+	write("root:x:0:0:root:/root\n")
+	_, err = ParsePasswdFile(tmpfile.Name())
+	require.Error(t, err)
+
+	users, err = ParsePasswdFile("/nonexistent")
+	require.NoError(t, err)
+	require.Empty(t, users)
+}